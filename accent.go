@@ -0,0 +1,212 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"log"
+	"sync"
+	"regexp"
+	"strconv"
+	"strings"
+	"path/filepath"
+)
+
+// accent color, as (ddd) in [0, 1]
+
+type rgb struct {
+	R float64
+	G float64
+	B float64
+}
+
+// out of range components mean "unset" per spec
+var noAccent = rgb{-1, -1, -1}
+
+// libadwaita palette for org.gnome.desktop.interface accent-color
+var gnomeAccents = map[string]string{
+	"blue":   "#3584e4",
+	"teal":   "#2190a4",
+	"green":  "#3a944a",
+	"yellow": "#c88800",
+	"orange": "#ed5b00",
+	"red":    "#e62d42",
+	"pink":   "#d56199",
+	"purple": "#9141ac",
+	"slate":  "#6f8396",
+}
+
+func parseColor(s string) (rgb, bool) {
+	s = strings.TrimSpace(s)
+
+	if hex, ok := strings.CutPrefix(s, "#"); ok {
+		if len(hex) == 3 {
+			hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+		}
+
+		if len(hex) != 6 {
+			return rgb{}, false
+		}
+
+		val, err := strconv.ParseUint(hex, 16, 32)
+
+		if err != nil {
+			return rgb{}, false
+		}
+
+		return rgb{
+			R: float64(val>>16&0xff) / 255,
+			G: float64(val>>8&0xff) / 255,
+			B: float64(val&0xff) / 255,
+		}, true
+	}
+
+	if args, ok := strings.CutPrefix(s, "rgb("); ok {
+		parts := strings.Split(strings.TrimSuffix(args, ")"), ",")
+
+		if len(parts) != 3 {
+			return rgb{}, false
+		}
+
+		var res [3]float64
+
+		for i, part := range parts {
+			val, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+
+			if err != nil || val < 0 || val > 255 {
+				return rgb{}, false
+			}
+
+			res[i] = val / 255
+		}
+
+		return rgb{res[0], res[1], res[2]}, true
+	}
+
+	return rgb{}, false
+}
+
+var defineColor = regexp.MustCompile(`@define-color\s+([\w-]+)\s+([^;]+);`)
+
+// resolve @define-color accent_color, following @name references
+func parseThemeAccent(css string) (rgb, bool) {
+	colors := map[string]string{}
+
+	for _, m := range defineColor.FindAllStringSubmatch(css, -1) {
+		colors[m[1]] = strings.TrimSpace(m[2])
+	}
+
+	for _, name := range []string{"accent_color", "accent_bg_color", "theme_selected_bg_color"} {
+		val, ok := colors[name]
+
+		for i := 0; ok && strings.HasPrefix(val, "@") && i < 8; i++ {
+			val, ok = colors[val[1:]]
+		}
+
+		if !ok {
+			continue
+		}
+
+		if res, ok := parseColor(val); ok {
+			return res, true
+		}
+	}
+
+	return rgb{}, false
+}
+
+func gtkThemeName() string {
+	if theme := os.Getenv("GTK_THEME"); theme != "" {
+		name, _, _ := strings.Cut(theme, ":")
+
+		return name
+	}
+
+	name, _ := gsettings("org.gnome.desktop.interface", "gtk-theme")
+
+	return name
+}
+
+func themeDirs() []string {
+	home, _ := homeDir()
+
+	res := []string{
+		filepath.Join(home, ".themes"),
+	}
+
+	for _, dir := range dataDirs() {
+		res = append(res, filepath.Join(dir, "themes"))
+	}
+
+	return res
+}
+
+func themeAccent(theme string) (rgb, bool) {
+	for _, dir := range themeDirs() {
+		for _, gtk := range []string{"gtk-4.0", "gtk-3.0"} {
+			data, err := os.ReadFile(filepath.Join(dir, theme, gtk, "gtk.css"))
+
+			if err != nil {
+				continue
+			}
+
+			if res, ok := parseThemeAccent(string(data)); ok {
+				return res, true
+			}
+		}
+	}
+
+	return rgb{}, false
+}
+
+type accentCache struct {
+	lock  sync.Mutex
+	key   string
+	color rgb
+}
+
+var accents accentCache
+
+// theme css is parsed once per theme, change of theme invalidates
+func (c *accentCache) get(theme string) rgb {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.key != theme {
+		res, ok := themeAccent(theme)
+
+		if !ok {
+			res = noAccent
+		}
+
+		c.key = theme
+		c.color = res
+	}
+
+	return c.color
+}
+
+func accentColor() rgb {
+	if val := config("ACCENT_COLOR", ""); val != "" {
+		if res, ok := parseColor(val); ok {
+			return res
+		}
+
+		log.Println("ignore bad PORTAL_ACCENT_COLOR", val)
+	}
+
+	if name, ok := gsettings("org.gnome.desktop.interface", "accent-color"); ok {
+		if res, ok := parseColor(gnomeAccents[name]); ok {
+			return res
+		}
+	}
+
+	if theme := gtkThemeName(); theme != "" {
+		return accents.get(theme)
+	}
+
+	return noAccent
+}
+
+func (c rgb) String() string {
+	return fmt.Sprintf("(%g, %g, %g)", c.R, c.G, c.B)
+}
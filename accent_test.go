@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"path/filepath"
+)
+
+func TestParseThemeAccent(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		css  string
+		want rgb
+		ok   bool
+	}{
+		{"hex", "@define-color accent_color #3584e4;", rgb{0x35 / 255.0, 0x84 / 255.0, 0xe4 / 255.0}, true},
+		{"short hex", "@define-color accent_color #f00;", rgb{1, 0, 0}, true},
+		{"rgb", "@define-color accent_color rgb(255, 0, 51);", rgb{1, 0, 51 / 255.0}, true},
+		{"reference", "@define-color blue_3 #0000ff;\n@define-color accent_color @blue_3;", rgb{0, 0, 1}, true},
+		{"adwaita fallback", "@define-color accent_bg_color #00ff00;", rgb{0, 1, 0}, true},
+		{"gtk3 fallback", "@define-color theme_selected_bg_color #ffffff;", rgb{1, 1, 1}, true},
+		{"accent wins", "@define-color theme_selected_bg_color #ffffff;\n@define-color accent_color #000000;", rgb{0, 0, 0}, true},
+		{"bad accent falls back", "@define-color accent_color mix(#fff, #000, 0.5);\n@define-color accent_bg_color #000;", rgb{0, 0, 0}, true},
+		{"reference loop", "@define-color a @b;\n@define-color b @a;\n@define-color accent_color @a;", rgb{}, false},
+		{"dangling reference", "@define-color accent_color @nowhere;", rgb{}, false},
+		{"none", "window { color: red; }", rgb{}, false},
+	} {
+		got, ok := parseThemeAccent(c.css)
+
+		if ok != c.ok || got != c.want {
+			t.Errorf("%s: got %v, %v, want %v, %v", c.name, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func writeThemeCSS(t *testing.T, dir string, theme string, gtk string, css string) {
+	t.Helper()
+
+	path := filepath.Join(dir, ".themes", theme, gtk, "gtk.css")
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte(css), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAccentCache(t *testing.T) {
+	dir := isolate(t)
+
+	writeThemeCSS(t, dir, "Red", "gtk-3.0", "@define-color accent_color #ff0000;")
+	writeThemeCSS(t, dir, "Blue", "gtk-3.0", "@define-color theme_selected_bg_color #ff0000;")
+	// gtk-4.0 comes first
+	writeThemeCSS(t, dir, "Blue", "gtk-4.0", "@define-color accent_color #0000ff;")
+
+	var c accentCache
+
+	if got := c.get("Red"); got != (rgb{1, 0, 0}) {
+		t.Errorf("Red = %v", got)
+	}
+
+	// parsed once per theme, an edit shows with the next theme change
+	writeThemeCSS(t, dir, "Red", "gtk-3.0", "@define-color accent_color #00ff00;")
+
+	if got := c.get("Red"); got != (rgb{1, 0, 0}) {
+		t.Errorf("Red reparsed without a theme change: %v", got)
+	}
+
+	if got := c.get("Blue"); got != (rgb{0, 0, 1}) {
+		t.Errorf("Blue = %v", got)
+	}
+
+	if got := c.get("Red"); got != (rgb{0, 1, 0}) {
+		t.Errorf("Red after a theme change = %v", got)
+	}
+
+	if got := c.get("Missing"); got != noAccent {
+		t.Errorf("missing theme = %v, want unset", got)
+	}
+}
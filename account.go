@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"log"
+	"io/fs"
+	"errors"
+	"os/user"
+	"strings"
+	"syscall"
+	"path/filepath"
+	"github.com/godbus/dbus/v5"
+)
+
+type Account struct {
+	portal *portal
+}
+
+// only a missing /.flatpak-info makes a host caller; a failed pid lookup or any
+// other error reading it counts as sandboxed, so what the check guards stays denied
+func isSandboxed(conn *dbus.Conn, sender string) (res bool) {
+	res = true
+
+	try(func() {
+		_, err := os.Stat(flatpakInfo(callerPid(conn, sender)))
+
+		res = !errors.Is(err, fs.ErrNotExist)
+
+		if err != nil && res {
+			log.Println("in isSandboxed, take", sender, "as sandboxed:", err)
+		}
+	}).catch(func(exc *Exception) {
+		log.Println("in isSandboxed, take", sender, "as sandboxed:", exc.what())
+	})
+
+	return res
+}
+
+// O_PATH, which syscall lacks; the value most linux ports share
+const oPath = 0x200000
+
+// export path through the document portal and grant it to app, the uri is what the sandbox sees
+func documentURI(conn *dbus.Conn, path string, app string) string {
+	// the document portal wants a handle on the file, not something opened for reading
+	fd, err := syscall.Open(path, oPath|syscall.O_CLOEXEC, 0)
+
+	if err != nil {
+		fmtException("can not open %s: %w", path, err).throw()
+	}
+
+	defer syscall.Close(fd)
+
+	obj := conn.Object("org.freedesktop.portal.Documents", "/org/freedesktop/portal/documents")
+
+	var id string
+
+	if err := obj.Call("org.freedesktop.portal.Documents.Add", 0, dbus.UnixFD(fd), true, false).Store(&id); err != nil {
+		fmtException("can not add %s to document portal: %w", path, err).throw()
+	}
+
+	// an added document is visible to no app until granted
+	if err := obj.Call("org.freedesktop.portal.Documents.GrantPermissions", 0, id, app, []string{"read"}).Err; err != nil {
+		fmtException("can not grant %s to %s: %w", path, app, err).throw()
+	}
+
+	var mount []byte
+
+	if err := obj.Call("org.freedesktop.portal.Documents.GetMountPoint", 0).Store(&mount); err != nil {
+		fmtException("can not get document portal mount point: %w", err).throw()
+	}
+
+	return fileURI(filepath.Join(strings.TrimRight(string(mount), "\x00"), id, filepath.Base(path)))
+}
+
+// image is omitted when there is no ~/.face, sandboxed callers get a document portal uri
+func (p *Account) userInformation(sender string) kv {
+	u, err := user.Current()
+
+	if err != nil {
+		fmtException("can not get current user: %w", err).throw()
+	}
+
+	name, _, _ := strings.Cut(u.Name, ",")
+
+	res := kv{
+		"id":   dbus.MakeVariant(u.Username),
+		"name": dbus.MakeVariant(name),
+	}
+
+	home, err := homeDir()
+
+	if err != nil {
+		fmtException("can not find home: %w", err).throw()
+	}
+
+	face := filepath.Join(home, ".face")
+
+	if _, err := os.Stat(face); err != nil {
+		return res
+	}
+
+	uri := fileURI(face)
+
+	if isSandboxed(p.portal.conn, sender) {
+		try(func() {
+			uri = documentURI(p.portal.conn, face, appID(p.portal.conn, sender))
+		}).catch(func(exc *Exception) {
+			log.Println("in GetUserInformation, omit image:", exc.what())
+			uri = ""
+		})
+	}
+
+	if uri != "" {
+		res["image"] = dbus.MakeVariant(uri)
+	}
+
+	return res
+}
+
+func (p *Account) GetUserInformation(sender dbus.Sender, window string, options kv) (dbus.ObjectPath, *dbus.Error) {
+	token, id := handleToken(options), correlationID()
+	logger := newLogger("GetUserInformation", sender, token, id)
+
+	logger.Println("enter", window, options)
+
+	if err := disabled("Account.GetUserInformation"); err != nil {
+		return "", err
+	}
+
+	if err := checkOptions("Account.GetUserInformation", options); err != nil {
+		return "", err
+	}
+
+	req, err := newRequest(p.portal, "Account.GetUserInformation", string(sender), token, id)
+
+	if err != nil {
+		return "", err
+	}
+
+	traceCall(req, options)
+
+	go func() {
+		try(func() {
+			var res kv
+
+			err := try(func() {
+				res = p.userInformation(string(sender))
+			})
+
+			if err != nil {
+				logger.Println(err.what())
+				req.response(2, kv{})
+			} else {
+				req.response(0, res)
+			}
+		}).catch(func(exc *Exception) {
+			logger.Println(exc.what())
+		})
+	}()
+
+	return req.path, nil
+}
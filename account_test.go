@@ -0,0 +1,207 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"syscall"
+	"testing"
+	"sync/atomic"
+	"path/filepath"
+	"github.com/godbus/dbus/v5"
+)
+
+// a document portal that remembers what it was asked to export
+type fakeDocuments struct {
+	lock  sync.Mutex
+	path  string
+	flags int
+	id    string
+	app   string
+	perms []string
+}
+
+func (d *fakeDocuments) Add(fd dbus.UnixFD, reuse bool, persistent bool) (string, *dbus.Error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	defer syscall.Close(int(fd))
+
+	fl, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFL, 0)
+
+	if errno != 0 {
+		return "", dbus.MakeFailedError(errno)
+	}
+
+	d.path, _ = os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+	d.flags = int(fl)
+
+	return "abc123", nil
+}
+
+func (d *fakeDocuments) GrantPermissions(id string, app string, perms []string) *dbus.Error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.id, d.app, d.perms = id, app, perms
+
+	return nil
+}
+
+func (d *fakeDocuments) GetMountPoint() ([]byte, *dbus.Error) {
+	return []byte("/run/user/1000/doc\x00"), nil
+}
+
+func serveDocuments(t *testing.T, addr string) *fakeDocuments {
+	t.Helper()
+
+	conn := testConn(t, addr)
+	docs := &fakeDocuments{}
+
+	if err := conn.Export(docs, "/org/freedesktop/portal/documents", "org.freedesktop.portal.Documents"); err != nil {
+		t.Fatal(err)
+	}
+
+	ownName(t, conn, "org.freedesktop.portal.Documents")
+
+	return docs
+}
+
+// callers look sandboxed as org.example.App once the returned flag is set;
+// installed before the portal runs, which reads it from its own goroutines
+func fakeSandbox(t *testing.T) *atomic.Bool {
+	info := filepath.Join(t.TempDir(), "flatpak-info")
+
+	if err := os.WriteFile(info, []byte("[Application]\nname=org.example.App\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var sandboxed atomic.Bool
+
+	saved := flatpakInfo
+
+	flatpakInfo = func(pid uint32) string {
+		if sandboxed.Load() {
+			return info
+		}
+
+		return saved(pid)
+	}
+
+	t.Cleanup(func() {
+		flatpakInfo = saved
+	})
+
+	return &sandboxed
+}
+
+func TestUserInformationImage(t *testing.T) {
+	sandboxed := fakeSandbox(t)
+
+	b := startPortal(t, nil)
+
+	face := filepath.Join(os.Getenv("HOME"), ".face")
+	calls := 0
+
+	image := func() (string, bool) {
+		t.Helper()
+
+		calls++
+
+		options := kv{"handle_token": dbus.MakeVariant(fmt.Sprintf("account%d", calls))}
+		code, results := b.request(t, "org.freedesktop.portal.Account.GetUserInformation", "", options)
+
+		if code != 0 {
+			t.Fatalf("GetUserInformation answered %d", code)
+		}
+
+		uri, ok := results["image"].Value().(string)
+
+		return uri, ok
+	}
+
+	if uri, ok := image(); ok {
+		t.Errorf("image %q without ~/.face", uri)
+	}
+
+	if err := os.WriteFile(face, []byte("png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if uri, _ := image(); uri != fileURI(face) {
+		t.Errorf("host caller image = %q, want %q", uri, fileURI(face))
+	}
+
+	sandboxed.Store(true)
+
+	// no document portal to export through
+	if uri, ok := image(); ok {
+		t.Errorf("image %q without a document portal", uri)
+	}
+
+	docs := serveDocuments(t, b.addr)
+
+	if uri, _ := image(); uri != "file:///run/user/1000/doc/abc123/.face" {
+		t.Errorf("sandboxed caller image = %q", uri)
+	}
+
+	docs.lock.Lock()
+	defer docs.lock.Unlock()
+
+	if docs.path != face || docs.flags&oPath == 0 {
+		t.Errorf("exported %q with flags %#x, want an O_PATH fd of %s", docs.path, docs.flags, face)
+	}
+
+	if docs.id != "abc123" || docs.app != "org.example.App" || len(docs.perms) != 1 || docs.perms[0] != "read" {
+		t.Errorf("granted %v on %q to %q, want read on abc123 to org.example.App", docs.perms, docs.id, docs.app)
+	}
+}
+
+func TestSandboxedFailsClosed(t *testing.T) {
+	// stat fails once broken is set, but not with ENOENT
+	file := filepath.Join(t.TempDir(), "file")
+
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var broken atomic.Bool
+
+	saved := flatpakInfo
+
+	flatpakInfo = func(pid uint32) string {
+		if broken.Load() {
+			return filepath.Join(file, ".flatpak-info")
+		}
+
+		return saved(pid)
+	}
+
+	t.Cleanup(func() {
+		flatpakInfo = saved
+	})
+
+	b := startPortal(t, nil)
+
+	me := b.client.Names()[0]
+
+	if isSandboxed(b.portal.conn, me) {
+		t.Errorf("host caller %s taken as sandboxed", me)
+	}
+
+	if !isSandboxed(b.portal.conn, ":1.999") {
+		t.Error("caller without a pid taken as a host one")
+	}
+
+	broken.Store(true)
+
+	if !isSandboxed(b.portal.conn, me) {
+		t.Error("unreadable /.flatpak-info taken as a host caller")
+	}
+
+	var mime string
+
+	if err := b.obj.Call(extNamespace+".OpenURI.QueryURIType", 0, fileURI(file)).Store(&mime); dbusErrorName(err) != "org.freedesktop.DBus.Error.AccessDenied" {
+		t.Errorf("file query with an unreadable /.flatpak-info: %q, %v, want AccessDenied", mime, err)
+	}
+}
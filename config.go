@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// --dump-config and Debug.DumpConfig: every PORTAL_* knob with its effective value
+// and where it came from, for "it is not using my setting" reports
+
+// defaults as passed to config() at the point of use, "" is off or unset
+var configDefaults = map[string]string{
+	"ACCENT_COLOR":                "",
+	"ALLOWED_PEERS":               "",
+	"DIALOG_NO_AT_BRIDGE":         "",
+	"DIALOG_THEME":                "follow",
+	"DISABLED_METHODS":            "",
+	"FILECHOOSER_AUTOANSWER":      "",
+	"FILECHOOSER_EMPTY_FILTER":    "skip",
+	"FILECHOOSER_MAX_URIS":        "5000",
+	"FILECHOOSER_OVERFLOW":        "fail",
+	"FILECHOOSER_PLUGIN":          "",
+	"FILECHOOSER_SAVE_AUTOANSWER": "",
+	"GSETTINGS_TTL":               "1s",
+	"HANDLER_TTL":                 "1m",
+	"HELPER_NICE":                 "",
+	"HELPER_SCOPE":                "",
+	"HOOK":                        "",
+	"HOOK_TIMEOUT":                "10s",
+	"MAX_DEPTH":                   "4",
+	"NO_HANDLER":                  "fail",
+	"ON_NAME_TAKEN":               "fail",
+	"OPEN_BACKEND":                "",
+	"OPEN_CHAIN":                  "",
+	"OPEN_COMMAND":                "",
+	"OPEN_SPAWN_WAIT":             "2s",
+	"RECORD":                      "",
+	"REDUCED_MOTION":              "",
+	"REPROBE_INTERVAL":            "0s",
+	"RESPONSE_BACKEND":            "",
+	"RESPONSE_ID":                 "",
+	"SCREENSHOT_COALESCE":         "0s",
+	"SCREENSHOT_WHEN_LOCKED":      "deny",
+	"SETTINGS_COALESCE":           "100ms",
+	"SHUTDOWN_GRACE":              "0s",
+	"STRICT":                      "",
+	"TIMEOUT_FILECHOOSER":         "10m",
+	"TIMEOUT_OPENURI":             "30s",
+	"TIMEOUT_SCREENSHOT":          "2m",
+	"URI_BASE":                    "$HOME",
+	"URI_SCHEMES":                 "",
+	"ZENITY_CHECK":                "",
+}
+
+// one resolved knob, Source is "default", "env" or "<file>:<line>" of a drop-in
+type configValue struct {
+	Name   string
+	Value  string
+	Source string
+}
+
+func effectiveConfig() []configValue {
+	var res []configValue
+
+	seen := map[string]bool{}
+
+	for name, def := range configDefaults {
+		seen["PORTAL_"+name] = true
+
+		val, src := def, "default"
+
+		if env, ok := os.LookupEnv("PORTAL_" + name); ok {
+			val, src = env, "env"
+		}
+
+		res = append(res, configValue{"PORTAL_" + name, val, src})
+	}
+
+	// set but read by nothing, usually a typo
+	for _, kv := range os.Environ() {
+		name, val, _ := strings.Cut(kv, "=")
+
+		if strings.HasPrefix(name, "PORTAL_") && !seen[name] && name != "PORTAL_DEPTH" {
+			res = append(res, configValue{name, val, "env, unknown"})
+		}
+	}
+
+	for i := range res {
+		if redacted(res[i].Name) && res[i].Value != "" {
+			res[i].Value = "<redacted>"
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+
+	dropins, from := readDropins()
+
+	for _, e := range (&portal{}).exports(nil) {
+		val, src := "on", "default"
+
+		if file, ok := from[e.iface]; ok {
+			src = file
+		}
+
+		if !interfaceEnabled(dropins, e.iface) {
+			val = "off"
+		}
+
+		res = append(res, configValue{e.iface, val, src})
+	}
+
+	return res
+}
+
+func dumpConfig() *table {
+	res := newTable("name", "value", "source")
+
+	for _, v := range effectiveConfig() {
+		res.add(v.Name, v.Value, v.Source)
+	}
+
+	return res
+}
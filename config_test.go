@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestEffectiveConfig(t *testing.T) {
+	isolate(t)
+
+	t.Setenv("PORTAL_HOOK_TIMEOUT", "5s")
+	t.Setenv("PORTAL_TYPOED", "1")
+	t.Setenv("PORTAL_API_TOKEN", "hunter2")
+	t.Setenv("PORTAL_MAX_DEPTH", "")
+	os.Unsetenv("PORTAL_MAX_DEPTH")
+
+	got := map[string]configValue{}
+
+	for _, v := range effectiveConfig() {
+		got[v.Name] = v
+	}
+
+	for _, want := range []configValue{
+		{"PORTAL_HOOK_TIMEOUT", "5s", "env"},
+		{"PORTAL_MAX_DEPTH", "4", "default"},
+		{"PORTAL_TYPOED", "1", "env, unknown"},
+		{"PORTAL_API_TOKEN", "<redacted>", "env, unknown"},
+		{"org.freedesktop.portal.OpenURI", "on", "default"},
+	} {
+		if got[want.Name] != want {
+			t.Errorf("%s = %+v, want %+v", want.Name, got[want.Name], want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"log"
+	"time"
+	"runtime/debug"
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+// read only facts about the serving process, so tooling can tell which portal answered
+
+var startTime = time.Now()
+
+type Debug struct {
+}
+
+func buildVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+
+	return "unknown"
+}
+
+// a(sss) of name, value and source, as --dump-config prints them
+func (p *Debug) DumpConfig() ([]configValue, *dbus.Error) {
+	log.Println("enter DumpConfig")
+
+	return effectiveConfig(), nil
+}
+
+func (p *Debug) properties() map[string]*prop.Prop {
+	return map[string]*prop.Prop{
+		"Pid": {
+			Value: uint32(os.Getpid()),
+		},
+		// unix seconds
+		"StartTime": {
+			Value: uint64(startTime.Unix()),
+		},
+		"Version": {
+			Value: buildVersion(),
+		},
+	}
+}
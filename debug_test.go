@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"time"
+	"testing"
+)
+
+func TestDebugProperties(t *testing.T) {
+	b := startPortal(t, nil)
+
+	const iface = extNamespace + ".Debug"
+
+	pid, err := b.obj.GetProperty(iface + ".Pid")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var owner uint32
+
+	if err := b.client.BusObject().Call("org.freedesktop.DBus.GetConnectionUnixProcessID", 0, "org.freedesktop.portal.Desktop").Store(&owner); err != nil {
+		t.Fatal(err)
+	}
+
+	// what the bus says holds the name
+	if pid.Value() != owner || owner != uint32(os.Getpid()) {
+		t.Errorf("Pid = %v, the bus says %d", pid, owner)
+	}
+
+	start, err := b.obj.GetProperty(iface + ".StartTime")
+
+	if at, _ := start.Value().(uint64); err != nil || at == 0 || at > uint64(time.Now().Unix()) {
+		t.Errorf("StartTime = %v, %v", start, err)
+	}
+
+	if v, err := b.obj.GetProperty(iface + ".Version"); err != nil || v.Value() == "" {
+		t.Errorf("Version = %v, %v", v, err)
+	}
+}
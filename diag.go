@@ -0,0 +1,285 @@
+package main
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"flag"
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+	"encoding/json"
+	"text/tabwriter"
+)
+
+// diagnostic subcommands
+
+type table struct {
+	columns []string
+	rows    [][]string
+}
+
+func newTable(columns ...string) *table {
+	return &table{
+		columns: columns,
+	}
+}
+
+func (t *table) add(row ...string) {
+	t.rows = append(t.rows, row)
+}
+
+func envName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+
+		return '_'
+	}, s)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// ansi colors only for terminals, NO_COLOR and TERM=dumb (without COLORTERM) turn them off
+func colorEnabled(w io.Writer) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+
+	if os.Getenv("TERM") == "dumb" && os.Getenv("COLORTERM") == "" {
+		return false
+	}
+
+	f, ok := w.(*os.File)
+
+	if !ok {
+		return false
+	}
+
+	st, err := f.Stat()
+
+	return err == nil && st.Mode()&os.ModeCharDevice != 0
+}
+
+var statusColors = map[string]string{
+	"ok":      "\x1b[32m",
+	"missing": "\x1b[31m",
+	"broken":  "\x1b[33m",
+}
+
+func colorStatus(status string) string {
+	if color, ok := statusColors[status]; ok {
+		return color + status + "\x1b[0m"
+	}
+
+	return status
+}
+
+func (t *table) renderTable(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	color := colorEnabled(w)
+
+	fmt.Fprintln(tw, strings.ToUpper(strings.Join(t.columns, "\t")))
+
+	for _, row := range t.rows {
+		cells := append([]string{}, row...)
+
+		for i, col := range t.columns {
+			if color && col == "status" {
+				cells[i] = colorStatus(cells[i])
+			}
+		}
+
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+
+	tw.Flush()
+}
+
+func (t *table) renderJSON(w io.Writer) {
+	res := []map[string]string{}
+
+	for _, row := range t.rows {
+		obj := map[string]string{}
+
+		for i, col := range t.columns {
+			obj[col] = row[i]
+		}
+
+		res = append(res, obj)
+	}
+
+	data, err := json.MarshalIndent(res, "", "  ")
+
+	if err != nil {
+		fmtException("can not render json: %w", err).throw()
+	}
+
+	fmt.Fprintln(w, string(data))
+}
+
+// first column names the row, NAME=value for 2 columns, NAME_COLUMN=value otherwise
+func (t *table) renderEnv(w io.Writer) {
+	for _, row := range t.rows {
+		if len(t.columns) == 2 {
+			fmt.Fprintf(w, "%s=%s\n", envName(row[0]), shellQuote(row[1]))
+
+			continue
+		}
+
+		for i := 1; i < len(t.columns); i++ {
+			fmt.Fprintf(w, "%s_%s=%s\n", envName(row[0]), envName(t.columns[i]), shellQuote(row[i]))
+		}
+	}
+}
+
+func (t *table) render(w io.Writer, format string) {
+	switch format {
+	case "table":
+		t.renderTable(w)
+	case "json":
+		t.renderJSON(w)
+	case "env":
+		t.renderEnv(w)
+	default:
+		fmtException("unknown format %s", format).withCode(exitConfig).throw()
+	}
+}
+
+func listSettings() *table {
+	res := newTable("key", "value")
+
+	for _, s := range settings {
+		res.add(s.namespace+"."+s.key, fmt.Sprint(s.value()))
+	}
+
+	return res
+}
+
+var backends = []struct {
+	prog  string
+	iface string
+}{
+	{"xdg-open-dispatch", "org.freedesktop.portal.OpenURI"},
+	{"xdg-open", "org.freedesktop.portal.OpenURI"},
+	{"gio", "org.freedesktop.portal.OpenURI"},
+	{"xdg-mime", extNamespace + ".OpenURI"},
+	{"zenity", "org.freedesktop.portal.FileChooser"},
+	{"grim", "org.freedesktop.portal.Screenshot"},
+	{"slurp", "org.freedesktop.portal.Screenshot"},
+	{"swaymsg", "org.freedesktop.portal.Screenshot"},
+	{"maim", "org.freedesktop.portal.Screenshot"},
+	{"slop", "org.freedesktop.portal.Screenshot"},
+	{"xrandr", "org.freedesktop.portal.Screenshot"},
+	{"gsettings", "org.freedesktop.portal.Settings"},
+}
+
+func listBackends() *table {
+	res := newTable("backend", "interface", "path", "status")
+
+	for _, b := range backends {
+		path, err := exec.LookPath(b.prog)
+
+		if err != nil {
+			res.add(b.prog, b.iface, "", "missing")
+		} else if b.prog == "zenity" && probeZenity() != "" {
+			res.add(b.prog, b.iface, path, "broken")
+		} else {
+			res.add(b.prog, b.iface, path, "ok")
+		}
+	}
+
+	return res
+}
+
+// portal open [--dry-run] [--app <id>] <uri>, OpenURI's resolveOpen without the bus;
+// --dry-run prints the command a real open would exec at the point it would exec it,
+// a confirm for programs and scripts is only logged
+func openCommand(args []string) {
+	flags := flag.NewFlagSet("portal open", flag.ContinueOnError)
+
+	dry := flags.Bool("dry-run", false, "print the command instead of running it")
+	app := flags.String("app", "", "resolve for this app id, as per app handlers see it")
+
+	if err := flags.Parse(args); errors.Is(err, flag.ErrHelp) {
+		exit(0)
+	} else if err != nil {
+		fmtException("bad command line: %w", err).withCode(exitConfig).throw()
+	}
+
+	if flags.NArg() != 1 {
+		fmtException("usage: portal open [--dry-run] [--app <id>] <uri>").withCode(exitConfig).throw()
+	}
+
+	uri := resolveURI(flags.Arg(0))
+
+	// run from something we launched, the loop guard counts us in
+	depth, _ := strconv.Atoi(os.Getenv("PORTAL_DEPTH"))
+
+	opts := openOptions{
+		env:     childEnv(depth),
+		depth:   depth,
+		app:     *app,
+		timeout: methodTimeout("OpenURI", nil),
+	}
+
+	if *dry {
+		opts.dryRun = func(argv []string) {
+			var quoted []string
+
+			for _, arg := range argv {
+				quoted = append(quoted, shellQuote(arg))
+			}
+
+			fmt.Println(strings.Join(quoted, " "))
+		}
+	}
+
+	if res := resolveOpen(xdgOpen, uri, false, opts); res.code != 0 {
+		fmtException("%s", res.reason).throw()
+	}
+}
+
+func cli(args []string) {
+	if len(args) > 0 && args[0] == "open" {
+		openCommand(args[1:])
+
+		return
+	}
+
+	flags := flag.NewFlagSet("portal", flag.ContinueOnError)
+
+	format := flags.String("format", "table", "diagnostic output format: table, json or env")
+	settings := flags.Bool("list-settings", false, "print settings served by the portal and exit")
+	backends := flags.Bool("backend-list", false, "print helper programs used by the portal and exit")
+	replace := flags.Bool("replace", false, "take the portal name over from a running instance")
+	self := flags.Bool("selftest", false, "serve on a private bus, round-trip a few calls and exit")
+	dump := flags.Bool("dump-config", false, "print the effective configuration and where each value comes from and exit")
+
+	if err := flags.Parse(args); errors.Is(err, flag.ErrHelp) {
+		exit(0)
+	} else if err != nil {
+		fmtException("bad command line: %w", err).withCode(exitConfig).throw()
+	}
+
+	switch {
+	case *settings:
+		listSettings().render(os.Stdout, *format)
+	case *backends:
+		listBackends().render(os.Stdout, *format)
+	case *self:
+		selftest()
+	case *dump:
+		dumpConfig().render(os.Stdout, *format)
+	default:
+		run(*replace)
+	}
+}
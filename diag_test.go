@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io"
+	"os"
+	"bytes"
+	"testing"
+)
+
+func sampleTable() *table {
+	res := newTable("name", "status", "path")
+
+	res.add("xdg-open", "ok", "/usr/bin/xdg-open")
+	res.add("gio open", "missing", "it's gone")
+
+	return res
+}
+
+func TestRenderJSON(t *testing.T) {
+	var buf bytes.Buffer
+
+	sampleTable().render(&buf, "json")
+
+	want := `[
+  {
+    "name": "xdg-open",
+    "path": "/usr/bin/xdg-open",
+    "status": "ok"
+  },
+  {
+    "name": "gio open",
+    "path": "it's gone",
+    "status": "missing"
+  }
+]
+`
+
+	if buf.String() != want {
+		t.Errorf("json:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	buf.Reset()
+	newTable("name").render(&buf, "json")
+
+	if buf.String() != "[]\n" {
+		t.Errorf("empty table rendered %q", buf.String())
+	}
+}
+
+func TestRenderEnv(t *testing.T) {
+	var buf bytes.Buffer
+
+	sampleTable().render(&buf, "env")
+
+	want := `XDG_OPEN_STATUS='ok'
+XDG_OPEN_PATH='/usr/bin/xdg-open'
+GIO_OPEN_STATUS='missing'
+GIO_OPEN_PATH='it'\''s gone'
+`
+
+	if buf.String() != want {
+		t.Errorf("env:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	buf.Reset()
+
+	two := newTable("key", "value")
+	two.add("org.gnome.desktop.interface.color-scheme", "1")
+	two.render(&buf, "env")
+
+	if want := "ORG_GNOME_DESKTOP_INTERFACE_COLOR_SCHEME='1'\n"; buf.String() != want {
+		t.Errorf("two columns rendered %q, want %q", buf.String(), want)
+	}
+}
+
+func TestRenderUnknownFormat(t *testing.T) {
+	exc := try(func() {
+		sampleTable().render(&bytes.Buffer{}, "yaml")
+	})
+
+	if exc == nil || exc.code != exitConfig {
+		t.Errorf("unknown format: %v, want a config error", exc)
+	}
+}
+
+func TestColorEnabled(t *testing.T) {
+	// /dev/null is a character device, so it stands in for a terminal
+	tty, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer tty.Close()
+
+	r, w, err := os.Pipe()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+	defer w.Close()
+
+	cases := []struct {
+		name      string
+		w         io.Writer
+		noColor   string
+		term      string
+		colorterm string
+		want      bool
+	}{
+		{"terminal", tty, "", "xterm", "", true},
+		{"no color", tty, "1", "xterm", "", false},
+		{"dumb", tty, "", "dumb", "", false},
+		{"dumb with colorterm", tty, "", "dumb", "truecolor", true},
+		{"pipe", w, "", "xterm", "", false},
+		{"buffer", &bytes.Buffer{}, "", "xterm", "", false},
+	}
+
+	for _, c := range cases {
+		t.Setenv("NO_COLOR", c.noColor)
+		t.Setenv("TERM", c.term)
+		t.Setenv("COLORTERM", c.colorterm)
+
+		if got := colorEnabled(c.w); got != c.want {
+			t.Errorf("%s: colorEnabled = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestColorStatus(t *testing.T) {
+	for status, want := range map[string]string{
+		"ok":      "\x1b[32mok\x1b[0m",
+		"missing": "\x1b[31mmissing\x1b[0m",
+		"broken":  "\x1b[33mbroken\x1b[0m",
+		"other":   "other",
+	} {
+		if got := colorStatus(status); got != want {
+			t.Errorf("colorStatus(%s) = %q, want %q", status, got, want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"path/filepath"
+)
+
+// everything the portal writes goes through here with explicit modes, the
+// umask we inherited does not get a say
+
+const (
+	privateFile os.FileMode = 0600
+	privateDir  os.FileMode = 0700
+)
+
+// like MkdirAll, directories we create are 0700, existing ones are left alone
+func makeDir(dir string) error {
+	if st, err := os.Stat(dir); err == nil {
+		if !st.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: os.ErrExist}
+		}
+
+		return nil
+	}
+
+	if err := makeDir(filepath.Dir(dir)); err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(dir, privateDir); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	return os.Chmod(dir, privateDir)
+}
+
+// for files written in place, a log appended to or a path handed to a helper;
+// created with mode, an existing one is brought to it
+func openFile(path string, flag int, mode os.FileMode) (*os.File, error) {
+	if err := makeDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, flag|os.O_CREATE, mode)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// an exclusive flock on .<name>.lock next to path, held across goroutines and
+// processes alike; the lock file stays, removing it would race the next locker
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".lock"), os.O_RDWR|os.O_CREATE, privateFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// readers never see a half written file: the data goes to a temp file next to
+// path and is renamed over it, under lockFile so writers of one path take turns
+func writeFile(path string, data []byte, mode os.FileMode) error {
+	dir := filepath.Dir(path)
+
+	if err := makeDir(dir); err != nil {
+		return err
+	}
+
+	unlock, err := lockFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// CreateTemp uses 0600, the caller may want something else
+	if err := f.Chmod(mode); err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
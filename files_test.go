@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"strings"
+	"syscall"
+	"testing"
+	"sync/atomic"
+	"path/filepath"
+	"encoding/json"
+)
+
+func TestFileModesIgnoreUmask(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, umask := range []int{0, 0077} {
+		old := syscall.Umask(umask)
+
+		path := filepath.Join(dir, "new", "dir", "file")
+
+		if err := writeFile(path, []byte("a"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if st, _ := os.Stat(path); st.Mode().Perm() != 0644 {
+			t.Errorf("umask %o: writeFile made %v, want 0644", umask, st.Mode())
+		}
+
+		if st, _ := os.Stat(filepath.Dir(path)); st.Mode().Perm() != privateDir {
+			t.Errorf("umask %o: makeDir made %v, want %v", umask, st.Mode(), privateDir)
+		}
+
+		log := filepath.Join(dir, "log")
+
+		if err := os.WriteFile(log, nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		os.Chmod(log, 0666)
+
+		f, err := openFile(log, os.O_WRONLY|os.O_APPEND, privateFile)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f.Close()
+
+		if st, _ := os.Stat(log); st.Mode().Perm() != privateFile {
+			t.Errorf("umask %o: openFile left %v, want %v", umask, st.Mode(), privateFile)
+		}
+
+		syscall.Umask(old)
+		os.RemoveAll(filepath.Join(dir, "new"))
+	}
+}
+
+func TestWriteFileReplaces(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f")
+
+	for _, val := range []string{"first, longer", "second"} {
+		if err := writeFile(path, []byte(val), privateFile); err != nil {
+			t.Fatal(err)
+		}
+
+		if data, _ := os.ReadFile(path); string(data) != val {
+			t.Errorf("read %q, want %q", data, val)
+		}
+	}
+
+	// no temp files left next to it, only the lock
+	if files, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".*")); len(files) != 1 || files[0] != filepath.Join(filepath.Dir(path), ".f.lock") {
+		t.Errorf("left behind %v", files)
+	}
+
+	if err := writeFile(filepath.Join(path, "below"), nil, privateFile); err == nil {
+		t.Error("writeFile below a regular file succeeded")
+	}
+}
+
+func TestWriteFileConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "f")
+
+	type value struct {
+		Writer int
+		Pad    string
+	}
+
+	var wg sync.WaitGroup
+	var torn atomic.Int32
+
+	stop := make(chan struct{})
+
+	// readers take no lock, every read must still be one whole value
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				data, err := os.ReadFile(path)
+
+				if err != nil {
+					continue
+				}
+
+				var v value
+
+				if json.Unmarshal(data, &v) != nil {
+					torn.Add(1)
+				}
+			}
+		}()
+	}
+
+	var writers sync.WaitGroup
+
+	for i := 0; i < 50; i++ {
+		writers.Add(1)
+
+		go func(i int) {
+			defer writers.Done()
+
+			data, _ := json.Marshal(value{Writer: i, Pad: strings.Repeat("x", 4096*(i%4+1))})
+
+			if err := writeFile(path, data, privateFile); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+
+	writers.Wait()
+	close(stop)
+	wg.Wait()
+
+	if n := torn.Load(); n != 0 {
+		t.Errorf("%d reads saw a torn file", n)
+	}
+
+	var last value
+
+	if data, err := os.ReadFile(path); err != nil || json.Unmarshal(data, &last) != nil || len(last.Pad) != 4096*(last.Writer%4+1) {
+		t.Errorf("final file %+v, %v, want one whole value", last, err)
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".f.*")); len(files) != 1 {
+		t.Errorf("left behind %v, want only the lock", files)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+	"context"
+	"os/exec"
+)
+
+// PORTAL_HOOK=<executable> runs after every Response as "<hook> <method> <app> <code>",
+// the same in PORTAL_HOOK_METHOD, PORTAL_HOOK_APP, PORTAL_HOOK_CODE and PORTAL_HOOK_ID.
+// Hooks never hold up a request: at most 4 run at once, each for PORTAL_HOOK_TIMEOUT
+// (10s by default), and events arriving while all slots are busy are dropped
+
+var hookSlots = make(chan struct{}, 4)
+
+func runHook(req *request, code uint32) {
+	hook := expandCommand(config("HOOK", ""))
+
+	if hook == "" {
+		return
+	}
+
+	select {
+	case hookSlots <- struct{}{}:
+	default:
+		log.Println("hooks busy, drop", req.method, req.path)
+
+		return
+	}
+
+	go func() {
+		defer func() {
+			<-hookSlots
+		}()
+
+		try(func() {
+			timeout, err := time.ParseDuration(config("HOOK_TIMEOUT", "10s"))
+
+			if err != nil {
+				log.Println("bad PORTAL_HOOK_TIMEOUT, use 10s:", err)
+				timeout = 10 * time.Second
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			// the caller may be gone by now, the app is empty then
+			app := appID(req.conn, req.sender)
+
+			cmd := exec.CommandContext(ctx, hook, req.method, app, fmt.Sprint(code))
+
+			cmd.Env = append(childEnv(callerDepth(req.conn, req.sender)),
+				"PORTAL_HOOK_METHOD="+req.method,
+				"PORTAL_HOOK_APP="+app,
+				fmt.Sprintf("PORTAL_HOOK_CODE=%d", code),
+				"PORTAL_HOOK_ID="+req.id,
+			)
+
+			if out, err := cmd.CombinedOutput(); err != nil {
+				log.Printf("hook %s for %s: %v: %s", hook, req.path, err, out)
+			}
+		}).catch(func(exc *Exception) {
+			log.Println("in runHook", exc.what())
+		})
+	}()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"path/filepath"
+)
+
+// $XDG_CONFIG_HOME/portal/interfaces.d/*.conf turn interfaces on and off,
+// one "<interface>=on|off" per line, files merged in lexical order so later ones win
+
+func interfaceDropins() map[string]bool {
+	res, _ := readDropins()
+
+	return res
+}
+
+// also says which file set each interface, for --dump-config
+func readDropins() (map[string]bool, map[string]string) {
+	res := map[string]bool{}
+	from := map[string]string{}
+
+	var files []string
+
+	try(func() {
+		files, _ = filepath.Glob(filepath.Join(configHome(), "portal", "interfaces.d", "*.conf"))
+	}).catch(func(exc *Exception) {
+		log.Println("in interfaceDropins", exc.what())
+	})
+
+	sort.Strings(files)
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+
+		if err != nil {
+			log.Println("can not read", file, err)
+
+			continue
+		}
+
+		for n, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			iface, val, _ := strings.Cut(line, "=")
+			iface = strings.TrimSpace(iface)
+
+			switch strings.ToLower(strings.TrimSpace(val)) {
+			case "on", "true", "yes", "1":
+				res[iface] = true
+			case "off", "false", "no", "0":
+				res[iface] = false
+			default:
+				log.Printf("%s:%d: want <interface>=on|off, got %q", file, n+1, line)
+
+				continue
+			}
+
+			from[iface] = fmt.Sprintf("%s:%d", file, n+1)
+		}
+	}
+
+	return res, from
+}
+
+// interfaces not mentioned by any drop-in stay on
+func interfaceEnabled(dropins map[string]bool, iface string) bool {
+	on, ok := dropins[iface]
+
+	return !ok || on
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"path/filepath"
+)
+
+func TestReadDropins(t *testing.T) {
+	dir := filepath.Join(isolate(t), "config", "portal", "interfaces.d")
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"10-base.conf":  "# the defaults\norg.freedesktop.portal.Screenshot=off\norg.freedesktop.portal.Account = on\n",
+		"50-local.conf": "org.freedesktop.portal.Screenshot=yes\norg.freedesktop.portal.Account=0\nbogus line\n",
+		"ignored.txt":   "org.freedesktop.portal.FileChooser=off\n",
+	}
+
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, from := readDropins()
+
+	// the later file wins
+	if !res["org.freedesktop.portal.Screenshot"] || res["org.freedesktop.portal.Account"] {
+		t.Errorf("dropins = %v, want 50-local.conf to win", res)
+	}
+
+	if want := filepath.Join(dir, "50-local.conf") + ":2"; from["org.freedesktop.portal.Account"] != want {
+		t.Errorf("Account set by %q, want %q", from["org.freedesktop.portal.Account"], want)
+	}
+
+	if _, ok := res["bogus line"]; ok {
+		t.Error("a malformed line was taken")
+	}
+
+	if !interfaceEnabled(res, "org.freedesktop.portal.FileChooser") {
+		t.Error("FileChooser is off, only *.conf files count")
+	}
+
+	if interfaceEnabled(res, "org.freedesktop.portal.Account") {
+		t.Error("Account is on after 50-local.conf turned it off")
+	}
+}
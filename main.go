@@ -4,18 +4,47 @@ import (
 	"os"
 	"fmt"
 	"log"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+	"context"
 	"os/exec"
+	"os/user"
+	"sort"
+	"strconv"
+	"regexp"
+	"crypto/rand"
+	"unicode"
+	"reflect"
 	"strings"
+	"syscall"
+	"os/signal"
+	"sync/atomic"
+	"path/filepath"
 	"github.com/godbus/dbus/v5"
 	"github.com/godbus/dbus/v5/prop"
+	"github.com/godbus/dbus/v5/introspect"
 )
 
 // exception runtime
 
 type Exception struct {
 	what func() error
+	code int
 }
 
+// process exit codes, for service managers to tell failure classes apart
+const (
+	exitFailure   = 1
+	exitNameTaken = 3
+	exitNoBus     = 4
+	exitConfig    = 5
+)
+
+// swapped out by tests to see the code
+var exit = os.Exit
+
 func (self *Exception) throw() {
 	panic(self)
 }
@@ -26,9 +55,20 @@ func (self *Exception) catch(cb func(*Exception)) {
 	}
 }
 
+// exit code carried by exception wins over the default one
 func (self *Exception) fatal(code int, prefix string) {
+	if self.code != 0 {
+		code = self.code
+	}
+
 	fmt.Fprintf(os.Stderr, "%s: %v\n", prefix, self.what())
-	os.Exit(code)
+	exit(code)
+}
+
+func (self *Exception) withCode(code int) *Exception {
+	self.code = code
+
+	return self
 }
 
 func newException(e error) *Exception {
@@ -74,214 +114,2649 @@ func lookPath(prog string) string {
 	return path
 }
 
-func xdgOpen(url string) {
-	args := []string{"xdg-open-dispatch", url}
-	path := lookPath(args[0])
+func config(name string, def string) string {
+	if val, ok := os.LookupEnv("PORTAL_" + name); ok {
+		return val
+	}
+
+	return def
+}
 
-	cmd := &exec.Cmd{
-		Path: path,
-		Args: args,
+// $HOME, or the passwd entry when a minimal service environment leaves it unset
+func homeDir() (string, error) {
+	if home := os.Getenv("HOME"); home != "" {
+		return home, nil
 	}
 
-	err := cmd.Run()
+	u, err := user.Current()
 
 	if err != nil {
-		fmtException("xdg-open-dispatch: %v", err).throw()
+		return "", fmt.Errorf("$HOME is not set and %w", err)
+	}
+
+	if u.HomeDir == "" {
+		return "", fmt.Errorf("$HOME is not set and %s has no home directory", u.Username)
 	}
+
+	return u.HomeDir, nil
 }
 
-type portal struct {
-	conn *dbus.Conn
+func readGsettings(schema string, key string) (string, bool) {
+	out, err := exec.Command("gsettings", "get", schema, key).Output()
+
+	if err != nil {
+		return "", false
+	}
+
+	return strings.Trim(strings.TrimSpace(string(out)), "'"), true
 }
 
-type request struct {
-	conn *dbus.Conn
-	path dbus.ObjectPath
+type gsettingsCall struct {
+	done chan struct{}
+	val  string
+	ok   bool
+	at   time.Time
 }
 
-func newRequest(conn *dbus.Conn, sender string, token string) *request {
-	sender, _ = strings.CutPrefix(sender, ":")
-	sender = strings.ReplaceAll(sender, ".", "_")
+// a theme change storm reads the same keys over and over; identical reads within
+// PORTAL_GSETTINGS_TTL (1s, 0 turns it off) share one gsettings run and any dconf
+// change drops everything, so a cached value never outlives the setting
+type gsettingsCache struct {
+	lock  sync.Mutex
+	calls map[string]*gsettingsCall
+	read  func(string, string) (string, bool)
+}
+
+var gsettingsReads = &gsettingsCache{
+	calls: map[string]*gsettingsCall{},
+	read:  readGsettings,
+}
+
+func (c *gsettingsCache) get(schema string, key string) (string, bool) {
+	ttl, err := time.ParseDuration(config("GSETTINGS_TTL", "1s"))
+
+	if err != nil || ttl <= 0 {
+		return c.read(schema, key)
+	}
+
+	id := schema + " " + key
+
+	c.lock.Lock()
+
+	if call, ok := c.calls[id]; ok {
+		select {
+		case <-call.done:
+			if time.Since(call.at) <= ttl {
+				c.lock.Unlock()
+
+				return call.val, call.ok
+			}
+		default:
+			c.lock.Unlock()
+			<-call.done
 
-	path := fmt.Sprintf("/org/freedesktop/portal/desktop/request/%s/%s", sender, token)
+			return call.val, call.ok
+		}
+	}
 
-	return &request{
-		conn: conn,
-		path: dbus.ObjectPath(path),
+	call := &gsettingsCall{
+		done: make(chan struct{}),
 	}
+
+	c.calls[id] = call
+
+	c.lock.Unlock()
+
+	defer close(call.done)
+
+	call.val, call.ok = c.read(schema, key)
+	call.at = time.Now()
+
+	return call.val, call.ok
 }
 
-func (r *request) response(errcode uint32, results kv) {
-	err := r.conn.Emit(r.path, "org.freedesktop.portal.Request.Response", errcode, results)
+// reads in flight finish for their callers but are not handed to new ones
+func (c *gsettingsCache) invalidate() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.calls = map[string]*gsettingsCall{}
+}
+
+func gsettings(schema string, key string) (string, bool) {
+	return gsettingsReads.get(schema, key)
+}
+
+func callerPid(conn *dbus.Conn, sender string) uint32 {
+	var pid uint32
+
+	err := conn.BusObject().Call("org.freedesktop.DBus.GetConnectionUnixProcessID", 0, sender).Store(&pid)
 
 	if err != nil {
-		fmtException("can not send response: %v", err).throw()
+		fmtException("can not get pid of %s: %w", sender, err).throw()
 	}
+
+	return pid
 }
 
-type OpenURI struct {
-	portal *portal
+// present only in flatpak sandboxes, swapped out by tests to fake one
+var flatpakInfo = func(pid uint32) string {
+	return fmt.Sprintf("/proc/%d/root/.flatpak-info", pid)
 }
 
-func (p *OpenURI) OpenURI(parent string, uri string, options *kv) *dbus.Error {
-	log.Println("enter OpenURI", parent, uri, options)
+// flatpak apps carry their id in /.flatpak-info, host apps go by executable name
+func appID(conn *dbus.Conn, sender string) (id string) {
+	try(func() {
+		pid := callerPid(conn, sender)
 
-	go func() {
-		try(func() {
-			xdgOpen(uri);
-		}).catch(func(exc *Exception) {
-			log.Println("in OpenURI", exc.what())
-		})
-	}()
+		if data, err := os.ReadFile(flatpakInfo(pid)); err == nil {
+			section := ""
 
-	return nil
-}
+			for _, line := range strings.Split(string(data), "\n") {
+				line = strings.TrimSpace(line)
 
-type FileChooser struct {
-	portal *portal
+				if strings.HasPrefix(line, "[") {
+					section = line
+				} else if val, ok := strings.CutPrefix(line, "name="); ok && section == "[Application]" {
+					id = val
+
+					return
+				}
+			}
+		}
+
+		if comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid)); err == nil {
+			id = strings.TrimSpace(string(comm))
+		}
+	}).catch(func(exc *Exception) {
+		log.Println("in appID", exc.what())
+	})
+
+	return id
 }
 
-func (p *FileChooser) OpenFile(sender dbus.Sender, parent string, title string, options kv) (dbus.ObjectPath, *dbus.Error) {
-	log.Println("enter OpenFile", sender, parent, title, options)
+// PORTAL_DEPTH is set on everything we spawn, a caller carrying it got here through us
+func callerDepth(conn *dbus.Conn, sender string) int {
+	depth := 0
 
-	tok := options["handle_token"]
-	req := newRequest(p.portal.conn, string(sender), tok.Value().(string))
+	try(func() {
+		data, err := os.ReadFile(fmt.Sprintf("/proc/%d/environ", callerPid(conn, sender)))
 
-	go func() {
-		try(func() {
-			pat, err := exec.Command("zenity", "--file-selection").Output()
+		if err != nil {
+			return
+		}
 
-			if err != nil {
-				log.Println(err)
-				req.response(1, kv{})
-			} else {
-				req.response(0, kv{
-					"uris": dbus.MakeVariant([]string{
-						"file://" + strings.TrimSpace(string(pat)),
-					}),
-				})
+		for _, env := range strings.Split(string(data), "\x00") {
+			if val, ok := strings.CutPrefix(env, "PORTAL_DEPTH="); ok {
+				depth, _ = strconv.Atoi(val)
 			}
-		}).catch(func(exc *Exception) {
-			log.Println("in OpenFile", exc.what())
-		})
-	}()
+		}
+	}).catch(func(exc *Exception) {
+		log.Println("in callerDepth", exc.what())
+	})
 
-	return req.path, nil
+	return depth
 }
 
-type Settings struct {
-	portal *portal
+func childEnv(depth int) []string {
+	return append(os.Environ(), fmt.Sprintf("PORTAL_DEPTH=%d", depth+1))
 }
 
-func box(v interface{}) *dbus.Variant {
-	if v == nil {
-		return nil
+func uriScheme(uri string) string {
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return ""
 	}
 
-	res := dbus.MakeVariant(v)
+	return strings.ToLower(u.Scheme)
+}
 
-	return &res
+// PORTAL_URI_SCHEMES is a comma separated allowlist, empty allows everything
+func schemeAllowed(scheme string) bool {
+	allowed := config("URI_SCHEMES", "")
+
+	if allowed == "" {
+		return true
+	}
+
+	for _, s := range strings.Split(allowed, ",") {
+		if strings.TrimSpace(s) == scheme {
+			return true
+		}
+	}
+
+	return false
 }
 
-func (p *Settings) ReadOne(sender dbus.Sender, namespace string, key string) (*dbus.Variant, *dbus.Error) {
-	log.Println("enter ReadOne", sender, namespace, key)
+// the scheme allowlist and the loop guard, depth is the caller's PORTAL_DEPTH
+func checkOpen(uri string, depth int) {
+	scheme := uriScheme(uri)
+
+	if !schemeAllowed(scheme) {
+		fmtException("scheme %q of %s is not allowed", scheme, uri).throw()
+	}
 
-	path := namespace + "." + key
+	limit, err := strconv.Atoi(config("MAX_DEPTH", "4"))
 
-	if path == "org.freedesktop.appearance.color-scheme" {
-		return box(uint32(1)), nil
+	if err != nil {
+		fmtException("bad PORTAL_MAX_DEPTH: %w", err).throw()
 	}
 
-	return nil, &dbus.ErrMsgNoObject
+	if depth >= limit {
+		fmtException("loop detected: caller reached portal depth %d, refusing to open %s", depth, uri).throw()
+	}
 }
 
-func (p *Settings) Read(sender dbus.Sender, namespace string, key string) (*dbus.Variant, *dbus.Error) {
-	res, err := p.ReadOne(sender, namespace, key)
+// open uri for sender, ask offers the chooser first; timeout bounds each dialog
+func (p *portal) open(ctx context.Context, logger *log.Logger, sender string, uri string, ask bool, timeout time.Duration) openResult {
+	depth := callerDepth(p.conn, sender)
+
+	return resolveOpen(p.opener, uri, ask, openOptions{
+		env:     childEnv(depth),
+		depth:   depth,
+		app:     appID(p.conn, sender),
+		logger:  logger,
+		ctx:     ctx,
+		timeout: timeout,
+	})
+}
 
-	return box(res), err
+func disabledMethods() []string {
+	res := []string{}
+
+	for _, m := range strings.Split(config("DISABLED_METHODS", ""), ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			res = append(res, m)
+		}
+	}
+
+	return res
+}
+
+// PORTAL_DISABLED_METHODS lists Interface.Method names, i.e. FileChooser.SaveFile;
+// disabled methods stay exported and answer NotSupported
+func disabled(method string) *dbus.Error {
+	for _, m := range disabledMethods() {
+		if m == method {
+			return dbus.NewError("org.freedesktop.DBus.Error.NotSupported", []any{
+				method + " is disabled by PORTAL_DISABLED_METHODS",
+			})
+		}
+	}
+
+	return nil
 }
 
-func bind(conn *dbus.Conn, service string) {
-	reply, err := conn.RequestName(service, dbus.NameFlagDoNotQueue)
+// option keys each method handles, FileChooser versions are derived from these so an
+// option goes here once the code acts on it; modal is a hint, there is no parent to be modal to
+var knownOptions = map[string][]string{
+	"OpenURI.OpenURI":            {"handle_token", "writable", "ask", "activation_token", "timeout"},
+	"OpenURI.OpenFile":           {"handle_token", "writable", "ask", "activation_token", "timeout"},
+	"OpenURI.OpenDirectory":      {"handle_token", "activation_token", "timeout"},
+	"FileChooser.OpenFile":       {"handle_token", "accept_label", "modal", "multiple", "directory", "filters", "current_filter", "choices", "current_folder", "metadata", "resolved_filters", "timeout"},
+	"FileChooser.SaveFile":       {"handle_token", "accept_label", "modal", "filters", "current_filter", "choices", "current_name", "current_folder", "current_file", "resolved_filters", "timeout"},
+	"FileChooser.SaveFiles":      {"handle_token", "accept_label", "modal", "choices", "current_folder", "files", "timeout"},
+	"Account.GetUserInformation": {"handle_token", "reason"},
+	"Screenshot.Screenshot":      {"handle_token", "modal", "interactive", "output", "timeout"},
+}
 
-	if err != nil {
-		fmtException("can not request name %s: %w", service, err).throw()
+// a developer aid, with a "strict" option (or PORTAL_STRICT=1) unknown keys are
+// InvalidArgument instead of being ignored as the spec says
+func checkOptions(method string, options kv) *dbus.Error {
+	strict, _ := options["strict"].Value().(bool)
+
+	if !strict && config("STRICT", "") != "1" {
+		return nil
+	}
+
+	known := map[string]bool{"strict": true}
+
+	for _, key := range knownOptions[method] {
+		known[key] = true
 	}
 
-	if reply != dbus.RequestNameReplyPrimaryOwner {
-		fmtException("name %s already taken", service).throw()
+	for key := range options {
+		if !known[key] {
+			return invalidArgument("%s does not know option %q", method, key)
+		}
 	}
+
+	return nil
 }
 
-func sessionBus() *dbus.Conn {
-	conn, err := dbus.ConnectSessionBus()
+const desktopPath = dbus.ObjectPath("/org/freedesktop/portal/desktop")
 
-	if err != nil {
-		fmtException("can not connect session bus %w", err).throw()
+// dialog and capture helpers, optionally reniced (PORTAL_HELPER_NICE) and placed in their
+// own systemd user scope (PORTAL_HELPER_SCOPE=1); by default they inherit ours
+func helperCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	argv := append([]string{name}, args...)
+
+	if nice := config("HELPER_NICE", ""); nice != "" {
+		if _, err := strconv.Atoi(nice); err != nil {
+			log.Println("bad PORTAL_HELPER_NICE, ignored:", err)
+		} else {
+			argv = append([]string{"nice", "-n", nice}, argv...)
+		}
 	}
 
-	return conn
+	if config("HELPER_SCOPE", "") == "1" {
+		argv = append([]string{"systemd-run", "--user", "--scope", "--quiet", "--collect", "--"}, argv...)
+	}
+
+	return exec.CommandContext(ctx, argv[0], argv[1:]...)
 }
 
-func run() {
-	conn := sessionBus()
-	defer conn.Close()
+// how long a method's helpers may run: FileChooser 10m, OpenURI 30s, Screenshot 2m,
+// PORTAL_TIMEOUT_<KIND> (i.e. PORTAL_TIMEOUT_FILECHOOSER=1h) or a non standard
+// "timeout" option in seconds (u or i) override
+func methodTimeout(kind string, options kv) time.Duration {
+	defaults := map[string]string{
+		"FileChooser": "10m",
+		"OpenURI":     "30s",
+		"Screenshot":  "2m",
+	}
+
+	var secs int64
 
-	path := dbus.ObjectPath("/org/freedesktop/portal/desktop")
+	switch v := options["timeout"].Value().(type) {
+	case uint32:
+		secs = int64(v)
+	case int32:
+		secs = int64(v)
+	}
 
-	portal := &portal{
-		conn: conn,
+	if secs > 0 {
+		return time.Duration(secs) * time.Second
 	}
 
-	ou := &OpenURI{
-		portal: portal,
+	if secs < 0 {
+		log.Println("bad timeout option", secs, "ignored")
 	}
 
-	conn.Export(ou, path, "org.freedesktop.portal.OpenURI")
+	res, err := time.ParseDuration(config("TIMEOUT_"+strings.ToUpper(kind), defaults[kind]))
+
+	if err != nil || res <= 0 {
+		log.Println("bad PORTAL_TIMEOUT_"+strings.ToUpper(kind)+", use", defaults[kind])
 
-	fc := &FileChooser{
-		portal: portal,
+		res, _ = time.ParseDuration(defaults[kind])
 	}
 
-	conn.Export(fc, path, "org.freedesktop.portal.FileChooser")
+	return res
+}
 
-	st := &Settings{
-		portal: portal,
+// failure to start a helper, permission errors on an existing binary usually come from MAC policy
+func execError(tool string, err error) string {
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, syscall.ENOENT) {
+		return fmt.Sprintf("%s not found: %v", tool, err)
 	}
 
-	conn.Export(st, path, "org.freedesktop.portal.Settings")
+	if errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EPERM) {
+		return fmt.Sprintf("%s: %v (exec denied, if the binary is executable check AppArmor/SELinux policy for the portal)", tool, err)
+	}
 
-	props := map[string]map[string]*prop.Prop{
-		"org.freedesktop.portal.OpenURI": {
-			"version": {
-				Value: uint32(4),
-			},
-		},
-		"org.freedesktop.portal.FileChooser": {
-			"version": {
-				Value: uint32(3),
-			},
-		},
-		"org.freedesktop.portal.Settings": {
-			"version": {
-				Value: uint32(1),
+	return fmt.Sprintf("%s: %v", tool, err)
+}
+
+// map dialog helper exit to response code: normal exit 1 is user cancel, anything else is failure
+func exitResponse(tool string, err error) (uint32, string) {
+	var exit *exec.ExitError
+
+	if !errors.As(err, &exit) {
+		return 2, execError(tool, err)
+	}
+
+	if ws, ok := exit.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 2, fmt.Sprintf("%s killed by signal %d", tool, ws.Signal())
+	}
+
+	// shell conventions, usually a wrapper script that could not run the real binary
+	switch exit.ExitCode() {
+	case 1:
+		return 1, fmt.Sprintf("%s cancelled", tool)
+	case 126:
+		return 2, fmt.Sprintf("%s exited 126, a command it runs is not executable", tool)
+	case 127:
+		return 2, fmt.Sprintf("%s exited 127, a command it runs was not found", tool)
+	}
+
+	return 2, fmt.Sprintf("%s failed with exit code %d", tool, exit.ExitCode())
+}
+
+type portal struct {
+	conn     *dbus.Conn
+	watchers *watchers
+	// how URIs get launched, swapped out by selftest
+	opener   func(uri string, opts openOptions) openResult
+	lock     sync.Mutex
+	// in flight requests, dropped on their terminal Response or Close
+	requests map[dbus.ObjectPath]*request
+	// counts requests, both it and draining are guarded by lock
+	inflight sync.WaitGroup
+	draining bool
+	// version of each exported interface as last published, only the reloader touches it
+	versions map[string]uint32
+}
+
+type request struct {
+	conn   *dbus.Conn
+	path   dbus.ObjectPath
+	portal *portal
+	closed atomic.Bool
+	// correlation id, see correlationID
+	id     string
+	// Iface.Method as in knownOptions
+	method string
+	sender string
+	// cancelled by Close and once the request is done, helpers run under it
+	ctx    context.Context
+	cancel func()
+	// what actually served it, "zenity 3.44", "grim", for the trace and
+	// PORTAL_RESPONSE_BACKEND; guarded by portal.lock, drain answers from another goroutine
+	backend string
+}
+
+func (r *request) setBackend(name string) {
+	r.portal.lock.Lock()
+	defer r.portal.lock.Unlock()
+
+	r.backend = name
+}
+
+func (r *request) usedBackend() string {
+	r.portal.lock.Lock()
+	defer r.portal.lock.Unlock()
+
+	return r.backend
+}
+
+// object path elements are [A-Za-z0-9_]+
+func pathElement(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x80 && (r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return r
+		}
+
+		return '_'
+	}, s)
+}
+
+// handle_token must already be a valid object path element, the spec says so;
+// rewriting a bad one would only hide the client bug
+func validToken(token string) bool {
+	return token != "" && pathElement(token) == token
+}
+
+func invalidArgument(format string, args ...any) *dbus.Error {
+	return dbus.NewError("org.freedesktop.portal.Error.InvalidArgument", []any{
+		fmt.Sprintf(format, args...),
+	})
+}
+
+// the one place sender and token become a request path, which also keys p.requests;
+// the sender is mangled as the spec says, the token is checked by validToken
+func requestKey(sender string, token string) dbus.ObjectPath {
+	sender, _ = strings.CutPrefix(sender, ":")
+
+	return dbus.ObjectPath(fmt.Sprintf("/org/freedesktop/portal/desktop/request/%s/%s", pathElement(sender), token))
+}
+
+// request objects introspect as one, so a client looking before the Response
+// finds Close and the signal; parents of request paths introspect as plain nodes
+var requestIntrospection = introspect.NewIntrospectable(&introspect.Node{
+	Interfaces: []introspect.Interface{{
+		Name: "org.freedesktop.portal.Request",
+		Methods: []introspect.Method{{
+			Name: "Close",
+		}},
+		Signals: []introspect.Signal{{
+			Name: "Response",
+			Args: []introspect.Arg{
+				{Name: "response", Type: "u"},
+				{Name: "results", Type: "a{sv}"},
 			},
-		},
+		}},
+	}},
+})
+
+func newRequest(p *portal, method string, sender string, token string, id string) (*request, *dbus.Error) {
+	if !validToken(token) {
+		return nil, invalidArgument("bad handle_token %q, want [A-Za-z0-9_]+", token)
+	}
+
+	path := requestKey(sender, token)
+
+	req := &request{
+		conn:   p.conn,
+		path:   path,
+		portal: p,
+		id:     id,
+		method: method,
+		sender: sender,
+	}
+
+	req.ctx, req.cancel = context.WithCancel(context.Background())
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.draining {
+		req.cancel()
+
+		return nil, dbus.MakeFailedError(errors.New("portal is shutting down"))
+	}
+
+	// exporting over it would orphan the live request, and its done would later
+	// unexport this one
+	if _, live := p.requests[path]; live {
+		req.cancel()
+
+		return nil, invalidArgument("handle_token %q is in use by a request in flight", token)
+	}
+
+	if err := p.conn.Export(req, path, "org.freedesktop.portal.Request"); err != nil {
+		req.cancel()
+
+		return nil, dbus.MakeFailedError(err)
+	}
+
+	p.conn.Export(requestIntrospection, path, "org.freedesktop.DBus.Introspectable")
+
+	p.requests[path] = req
+	p.inflight.Add(1)
+
+	return req, nil
+}
+
+// forget the request whether or not anybody listened for its Response
+func (r *request) done() {
+	r.cancel()
+
+	r.portal.lock.Lock()
+	defer r.portal.lock.Unlock()
+
+	if r.portal.requests[r.path] == r {
+		delete(r.portal.requests, r.path)
+		r.conn.Export(nil, r.path, "org.freedesktop.portal.Request")
+		r.conn.Export(nil, r.path, "org.freedesktop.DBus.Introspectable")
 	}
 
-	_, err := prop.Export(conn, path, props)
+	r.portal.inflight.Done()
+}
+
+// on shutdown new calls fail, those in flight get PORTAL_SHUTDOWN_GRACE (0s by
+// default) to finish; the rest then fail with code 2, which kills their helpers
+func (p *portal) drain() {
+	grace, err := time.ParseDuration(config("SHUTDOWN_GRACE", "0s"))
 
 	if err != nil {
-		fmtException("can not bind properties: %w", err).throw()
+		log.Println("bad PORTAL_SHUTDOWN_GRACE, ignored:", err)
+	}
+
+	p.lock.Lock()
+	p.draining = true
+	p.lock.Unlock()
+
+	idle := make(chan struct{})
+
+	go func() {
+		p.inflight.Wait()
+		close(idle)
+	}()
+
+	select {
+	case <-idle:
+		return
+	case <-time.After(grace):
+	}
+
+	p.lock.Lock()
+
+	var left []*request
+
+	for _, r := range p.requests {
+		left = append(left, r)
 	}
 
-	bind(conn, "org.freedesktop.portal.Desktop")
+	p.lock.Unlock()
+
+	for _, r := range left {
+		log.Println("grace period over, fail", r.path)
+
+		try(func() {
+			r.response(2, kv{})
+		}).catch(func(exc *Exception) {
+			log.Println("in drain", exc.what())
+		})
+	}
+
+	<-idle
+}
+
+// kills the dialog or helper, its result is dropped; only the caller that
+// made the request may close it
+func (r *request) Close(sender dbus.Sender) *dbus.Error {
+	log.Println("enter Close", r.path, sender)
+
+	if string(sender) != r.sender {
+		return dbus.NewError("org.freedesktop.DBus.Error.AccessDenied", []any{
+			"only the caller that made the request may close it",
+		})
+	}
+
+	if r.closed.CompareAndSwap(false, true) {
+		r.done()
+	}
+
+	return nil
+}
+
+var tokens atomic.Uint64
+
+func handleToken(options kv) string {
+	if tok, ok := options["handle_token"].Value().(string); ok {
+		return tok
+	}
+
+	return fmt.Sprintf("portal%d", tokens.Add(1))
+}
+
+// ours, unlike the client chosen handle_token, so logs of different clients never collide
+func correlationID() string {
+	var buf [4]byte
+
+	if _, err := rand.Read(buf[:]); err != nil {
+		return fmt.Sprintf("n%d", tokens.Add(1))
+	}
+
+	return fmt.Sprintf("%x", buf)
+}
+
+// request scoped logger, every line carries method, sender and token
+func newLogger(method string, sender dbus.Sender, token string, id string) *log.Logger {
+	prefix := fmt.Sprintf("method=%s sender=%s token=%s id=%s ", method, sender, token, id)
+
+	return log.New(log.Writer(), prefix, log.Flags()|log.Lmsgprefix)
+}
+
+func (r *request) response(errcode uint32, results kv) {
+	if !r.closed.CompareAndSwap(false, true) {
+		log.Println("request", r.path, "closed, drop response", errcode)
+
+		return
+	}
+
+	defer r.done()
+
+	// non standard, PORTAL_RESPONSE_ID=1 echoes the id for matching client and portal logs
+	if config("RESPONSE_ID", "") == "1" {
+		results["correlation_id"] = dbus.MakeVariant(r.id)
+	}
+
+	backend := r.usedBackend()
+
+	// non standard, PORTAL_RESPONSE_BACKEND=1 names the backend behind the answer
+	if config("RESPONSE_BACKEND", "") == "1" && backend != "" {
+		results["backend"] = dbus.MakeVariant(backend)
+	}
+
+	traceResponse(r, errcode, results, backend)
+
+	err := r.conn.Emit(r.path, "org.freedesktop.portal.Request.Response", errcode, results)
+
+	if err != nil {
+		fmtException("can not send response: %v", err).throw()
+	}
+
+	runHook(r, errcode)
+}
+
+type OpenURI struct {
+	portal *portal
+}
+
+// timeout bounds each dialog on the way, the launcher only gets its spawn wait
+func (p *OpenURI) dispatch(req *request, logger *log.Logger, sender string, uri string, ask bool, timeout time.Duration) {
+	go func() {
+		try(func() {
+			var res openResult
+
+			err := try(func() {
+				res = p.portal.open(req.ctx, logger, sender, uri, ask, timeout)
+			})
+
+			req.setBackend(res.backend)
+
+			if err != nil {
+				logger.Println(err.what())
+				req.response(2, kv{})
+
+				return
+			}
+
+			if res.code != 0 {
+				logger.Println(res.reason)
+				req.response(res.code, kv{})
+
+				return
+			}
+
+			results := kv{}
+
+			// non standard, for "opened in Firefox" style feedback
+			if res.handler != "" {
+				results["handler"] = dbus.MakeVariant(res.handler)
+			}
+
+			req.response(0, results)
+		}).catch(func(exc *Exception) {
+			logger.Println(exc.what())
+		})
+	}()
+}
+
+// bare paths and relative file: references resolve against PORTAL_URI_BASE, home by default
+func resolveURI(uri string) string {
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return uri
+	}
+
+	var path string
+
+	switch {
+	case u.Scheme == "" && u.Path != "":
+		path = u.Path
+	case u.Scheme == "file" && u.Opaque != "":
+		if path, err = url.PathUnescape(u.Opaque); err != nil {
+			return uri
+		}
+	default:
+		return uri
+	}
+
+	if !filepath.IsAbs(path) {
+		home, _ := homeDir()
+		path = filepath.Join(config("URI_BASE", home), path)
+	}
+
+	return fileURI(path)
+}
+
+func (p *OpenURI) OpenURI(sender dbus.Sender, parent string, uri string, options kv) (dbus.ObjectPath, *dbus.Error) {
+	token, id := handleToken(options), correlationID()
+	logger := newLogger("OpenURI", sender, token, id)
+
+	logger.Println("enter", parent, uri, options)
+
+	if err := disabled("OpenURI.OpenURI"); err != nil {
+		return "", err
+	}
+
+	if err := checkOptions("OpenURI.OpenURI", options); err != nil {
+		return "", err
+	}
+
+	req, err := newRequest(p.portal, "OpenURI.OpenURI", string(sender), token, id)
+
+	if err != nil {
+		return "", err
+	}
+
+	traceCall(req, options, uri)
+
+	if res := resolveURI(uri); res != uri {
+		logger.Println("resolved", uri, "to", res)
+		uri = res
+	}
+
+	ask, _ := options["ask"].Value().(bool)
+
+	p.dispatch(req, logger, string(sender), uri, ask, methodTimeout("OpenURI", options))
+
+	return req.path, nil
+}
+
+func fileURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
+
+// resolve client fd to the path it was opened with, fd is always consumed
+func fdPath(fd dbus.UnixFD) string {
+	if fd < 0 {
+		fmtException("invalid fd %d", fd).throw()
+	}
+
+	defer syscall.Close(int(fd))
+
+	var st syscall.Stat_t
+
+	if err := syscall.Fstat(int(fd), &st); err != nil {
+		fmtException("invalid fd %d: %w", fd, err).throw()
+	}
+
+	path, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+
+	if err != nil {
+		fmtException("can not resolve fd %d: %w", fd, err).throw()
+	}
+
+	return path
+}
+
+// without a unix_fds header fd is still an index into nothing, not one of our descriptors
+func declaredFds(msg dbus.Message) uint32 {
+	n, _ := msg.Headers[dbus.FieldUnixFDs].Value().(uint32)
+
+	return n
+}
+
+func (p *OpenURI) OpenFile(sender dbus.Sender, msg dbus.Message, parent string, fd dbus.UnixFD, options kv) (dbus.ObjectPath, *dbus.Error) {
+	token, id := handleToken(options), correlationID()
+	logger := newLogger("OpenURI.OpenFile", sender, token, id)
+
+	logger.Println("enter", parent, fd, options)
+
+	if declaredFds(msg) == 0 {
+		return "", invalidArgument("OpenFile with no fd attached")
+	}
+
+	if err := disabled("OpenURI.OpenFile"); err != nil {
+		syscall.Close(int(fd))
+
+		return "", err
+	}
+
+	if err := checkOptions("OpenURI.OpenFile", options); err != nil {
+		syscall.Close(int(fd))
+
+		return "", err
+	}
+
+	req, err := newRequest(p.portal, "OpenURI.OpenFile", string(sender), token, id)
+
+	if err != nil {
+		syscall.Close(int(fd))
+
+		return "", err
+	}
+
+	traceCall(req, options)
+
+	var path string
+
+	exc := try(func() {
+		path = fdPath(fd)
+	})
+
+	if exc == nil {
+		ask, _ := options["ask"].Value().(bool)
+
+		p.dispatch(req, logger, string(sender), fileURI(path), ask, methodTimeout("OpenURI", options))
+
+		return req.path, nil
+	}
+
+	go func() {
+		try(func() {
+			logger.Println("not found:", exc.what())
+			req.response(2, kv{})
+		}).catch(func(exc *Exception) {
+			logger.Println(exc.what())
+		})
+	}()
+
+	return req.path, nil
+}
+
+// a file manager implementing FileManager1 opens the folder with the file selected;
+// without one the folder still opens through the open backend, just with nothing selected
+func (p *OpenURI) showItem(ctx context.Context, logger *log.Logger, sender string, path string, options kv) openResult {
+	token, _ := options["activation_token"].Value().(string)
+
+	obj := p.portal.conn.Object("org.freedesktop.FileManager1", "/org/freedesktop/FileManager1")
+
+	call := obj.CallWithContext(ctx, "org.freedesktop.FileManager1.ShowItems", 0, []string{fileURI(path)}, token)
+
+	if call.Err == nil {
+		return openResult{handler: "FileManager1", backend: "FileManager1"}
+	}
+
+	logger.Println("no selection, FileManager1 failed:", call.Err)
+
+	return p.portal.open(ctx, logger, sender, fileURI(filepath.Dir(path)), false, methodTimeout("OpenURI", options))
+}
+
+func (p *OpenURI) OpenDirectory(sender dbus.Sender, msg dbus.Message, parent string, fd dbus.UnixFD, options kv) (dbus.ObjectPath, *dbus.Error) {
+	token, id := handleToken(options), correlationID()
+	logger := newLogger("OpenURI.OpenDirectory", sender, token, id)
+
+	logger.Println("enter", parent, fd, options)
+
+	if declaredFds(msg) == 0 {
+		return "", invalidArgument("OpenDirectory with no fd attached")
+	}
+
+	if err := disabled("OpenURI.OpenDirectory"); err != nil {
+		syscall.Close(int(fd))
+
+		return "", err
+	}
+
+	if err := checkOptions("OpenURI.OpenDirectory", options); err != nil {
+		syscall.Close(int(fd))
+
+		return "", err
+	}
+
+	req, err := newRequest(p.portal, "OpenURI.OpenDirectory", string(sender), token, id)
+
+	if err != nil {
+		syscall.Close(int(fd))
+
+		return "", err
+	}
+
+	traceCall(req, options)
+
+	var path string
+
+	exc := try(func() {
+		path = fdPath(fd)
+	})
+
+	go func() {
+		try(func() {
+			if exc != nil {
+				logger.Println("not found:", exc.what())
+				req.response(2, kv{})
+
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(req.ctx, methodTimeout("OpenURI", options))
+			defer cancel()
+
+			var res openResult
+
+			err := try(func() {
+				res = p.showItem(ctx, logger, string(sender), path, options)
+			})
+
+			req.setBackend(res.backend)
+
+			if err != nil {
+				logger.Println(err.what())
+				req.response(2, kv{})
+
+				return
+			}
+
+			if res.code != 0 {
+				logger.Println(res.reason)
+				req.response(res.code, kv{})
+
+				return
+			}
+
+			results := kv{}
+
+			if res.handler != "" {
+				results["handler"] = dbus.MakeVariant(res.handler)
+			}
+
+			req.response(0, results)
+		}).catch(func(exc *Exception) {
+			logger.Println(exc.what())
+		})
+	}()
+
+	return req.path, nil
+}
+
+const extNamespace = "com.github.pg83.portal"
+
+// non standard OpenURI helpers, exported under extNamespace
+type OpenURIExt struct {
+	portal *portal
+}
+
+func (p *OpenURIExt) SchemeSupported(scheme string) (bool, *dbus.Error) {
+	log.Println("enter SchemeSupported", scheme)
+
+	scheme = strings.ToLower(scheme)
+
+	if scheme == "" || !schemeAllowed(scheme) {
+		return false, nil
+	}
+
+	// files go by mime type, not by scheme handler
+	if scheme == "file" {
+		return true, nil
+	}
+
+	return schemeHandler(scheme) != "", nil
+}
+
+// the type OpenURI would go by, files by extension and content, others by scheme;
+// sandboxed callers get no file answers, those would tell which host paths exist
+func (p *OpenURIExt) QueryURIType(sender dbus.Sender, uri string) (string, *dbus.Error) {
+	log.Println("enter QueryURIType", uri, sender)
+
+	u, err := url.Parse(uri)
+
+	if err != nil || u.Scheme == "" {
+		return "", invalidArgument("bad uri %q", uri)
+	}
+
+	if strings.ToLower(u.Scheme) == "file" {
+		if isSandboxed(p.portal.conn, string(sender)) {
+			return "", dbus.NewError("org.freedesktop.DBus.Error.AccessDenied", []any{
+				"sandboxed callers may not query file uris",
+			})
+		}
+
+		f, err := os.Open(u.Path)
+
+		if errors.Is(err, os.ErrNotExist) {
+			return "", dbus.NewError("org.freedesktop.portal.Error.NotFound", []any{
+				fmt.Sprintf("%s does not exist", u.Path),
+			})
+		}
+
+		if err != nil {
+			return "", dbus.MakeFailedError(fmt.Errorf("can not read %s: %w", u.Path, err))
+		}
+
+		f.Close()
+	}
+
+	mime := uriMimeType(uri)
+
+	if mime == "" {
+		return "", dbus.MakeFailedError(fmt.Errorf("can not tell the type of %s", uri))
+	}
+
+	return mime, nil
+}
+
+type FileChooser struct {
+	portal *portal
+}
+
+// byte string options are NUL terminated
+func bytesOption(options kv, key string) string {
+	val, _ := options[key].Value().([]byte)
+
+	return strings.TrimRight(string(val), "\x00")
+}
+
+func isDir(path string) bool {
+	st, err := os.Stat(path)
+
+	return err == nil && st.IsDir()
+}
+
+// clients send ~/Documents more often than they should and zenity takes it literally;
+// only a leading ~ or ~/ is ours to expand
+func expandTilde(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+
+	home, err := homeDir()
+
+	if err != nil {
+		return path
+	}
+
+	return home + path[1:]
+}
+
+// explicit current_folder, then where this app left off, then home
+func startFolder(options kv, app string) string {
+	if dir := bytesOption(options, "current_folder"); dir != "" {
+		return expandTilde(dir)
+	}
+
+	if dir := lastFolders.get(app); dir != "" && isDir(dir) {
+		return dir
+	}
+
+	home, _ := homeDir()
+
+	return home
+}
+
+// PORTAL_FILECHOOSER_AUTOANSWER and PORTAL_FILECHOOSER_SAVE_AUTOANSWER answer
+// without any dialog, for scripted tests and kiosks; SaveFiles takes the latter as its folder
+func autoAnswer(method string) string {
+	if method == "SaveFile" || method == "SaveFiles" {
+		return config("FILECHOOSER_SAVE_AUTOANSWER", "")
+	}
+
+	return config("FILECHOOSER_AUTOANSWER", "")
+}
+
+// too many uris choke clients: PORTAL_FILECHOOSER_MAX_URIS caps the count,
+// PORTAL_FILECHOOSER_OVERFLOW=fail (default) rejects, truncate cuts the list
+func capSelection(logger *log.Logger, paths []string) []string {
+	limit, err := strconv.Atoi(config("FILECHOOSER_MAX_URIS", "5000"))
+
+	if err != nil {
+		fmtException("bad PORTAL_FILECHOOSER_MAX_URIS: %w", err).throw()
+	}
+
+	// the answer always holds at least one file
+	if limit < 1 {
+		fmtException("bad PORTAL_FILECHOOSER_MAX_URIS %d, want at least 1", limit).throw()
+	}
+
+	if len(paths) <= limit {
+		return paths
+	}
+
+	switch policy := config("FILECHOOSER_OVERFLOW", "fail"); policy {
+	case "truncate":
+		logger.Printf("selected %d files, truncate to %d", len(paths), limit)
+
+		return paths[:limit]
+	case "fail":
+		fmtException("selected %d files, more than %d allowed", len(paths), limit).throw()
+	default:
+		fmtException("bad PORTAL_FILECHOOSER_OVERFLOW %s, want fail or truncate", policy).throw()
+	}
+
+	return nil
+}
+
+func activeDialogBackend() string {
+	if autoAnswer("OpenFile") != "" || autoAnswer("SaveFile") != "" {
+		return "autoanswer"
+	}
+
+	if config("FILECHOOSER_PLUGIN", "") != "" {
+		return "plugin"
+	}
+
+	return "zenity"
+}
+
+var zenityVersion = regexp.MustCompile(`^\d+\.\d+`)
+
+// "" when zenity runs and prints a version, else what is wrong with it
+func probeZenity() string {
+	_, problem := zenityInfo()
+
+	return problem
+}
+
+// the version zenity prints, or "" and what is wrong with it
+func zenityInfo() (string, string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cmd := helperCommand(ctx, "zenity", "--version")
+	cmd.Env = dialogEnv()
+
+	out, err := cmd.Output()
+
+	var exit *exec.ExitError
+
+	if errors.As(err, &exit) {
+		// what gtk complains about is the useful part
+		return "", fmt.Sprintf("zenity --version: %v: %s", err, strings.TrimSpace(string(exit.Stderr)))
+	}
+
+	if err != nil {
+		return "", execError("zenity", err)
+	}
+
+	v := strings.TrimSpace(string(out))
+
+	if !zenityVersion.MatchString(v) {
+		return "", fmt.Sprintf("zenity --version printed %q", v)
+	}
+
+	return v, ""
+}
+
+// PORTAL_ZENITY_CHECK=1 probes zenity on startup and SIGHUP; one installed but broken
+// (missing gtk modules, crashing at start) would fail every dialog, so FileChooser
+// stays unexported and xdg-desktop-portal falls back to the next backend
+var zenityProblem atomic.Value
+
+func checkZenity() {
+	problem := ""
+
+	if config("ZENITY_CHECK", "") == "1" && activeDialogBackend() == "zenity" {
+		problem = probeZenity()
+	}
+
+	if problem != "" {
+		log.Println("zenity is unhealthy, FileChooser not exported:", problem)
+	}
+
+	zenityProblem.Store(problem)
+}
+
+// why an interface can not be served right now, "" if it can
+func unhealthy(iface string) string {
+	if iface == "org.freedesktop.portal.FileChooser" {
+		problem, _ := zenityProblem.Load().(string)
+
+		return problem
+	}
+
+	return ""
+}
+
+func selectionSeparator() string {
+	var buf [8]byte
+
+	if _, err := rand.Read(buf[:]); err != nil {
+		log.Println("can not make separator, fall back to newline:", err)
+
+		return "\n"
+	}
+
+	return fmt.Sprintf("\x1fportal-%x\x1f", buf)
+}
+
+// the user's own gnome color-scheme, "" when none is set or it can not be read;
+// colorScheme is a fixed answer and says nothing about the user
+func preferredScheme() string {
+	switch val, _ := gsettings("org.gnome.desktop.interface", "color-scheme"); val {
+	case "prefer-dark":
+		return "dark"
+	case "prefer-light":
+		return "light"
+	}
+
+	return ""
+}
+
+// environment of dialog helpers, nil to inherit ours; PORTAL_DIALOG_THEME=dark|light pins
+// the dialog variant, by default it follows the user's color-scheme; GTK_THEME is left
+// alone when there is no preference or no theme name to give it
+func dialogEnv() []string {
+	mode := config("DIALOG_THEME", "follow")
+
+	if mode == "follow" {
+		if scheme := preferredScheme(); scheme != "" {
+			mode = scheme
+		}
+	}
+
+	var extra []string
+
+	// opt in, the a11y bridge is what screen readers need; a broken accessibility
+	// bus otherwise delays every gtk dialog start by its connect timeout
+	if config("DIALOG_NO_AT_BRIDGE", "") == "1" {
+		extra = append(extra, "NO_AT_BRIDGE=1")
+	}
+
+	switch mode {
+	case "dark", "light":
+		theme := gtkThemeName()
+
+		if theme == "" {
+			log.Println("no gtk theme name, leave the dialog", mode, "variant to gtk")
+		} else if mode == "dark" {
+			extra = append(extra, "GTK_THEME="+theme+":dark")
+		} else {
+			extra = append(extra, "GTK_THEME="+theme)
+		}
+	case "follow":
+	default:
+		log.Println("bad PORTAL_DIALOG_THEME", mode, "want dark, light or follow")
+	}
+
+	if len(extra) == 0 {
+		return nil
+	}
+
+	return append(os.Environ(), extra...)
+}
+
+// non standard, uri -> {size, mtime}, files that can not be stat'ed are left out
+func fileMetadata(logger *log.Logger, paths []string) map[string]kv {
+	res := map[string]kv{}
+
+	for _, path := range paths {
+		st, err := os.Stat(path)
+
+		if err != nil {
+			logger.Println("no metadata:", err)
+
+			continue
+		}
+
+		res[fileURI(path)] = kv{
+			"size":  dbus.MakeVariant(uint64(st.Size())),
+			"mtime": dbus.MakeVariant(uint64(st.ModTime().Unix())),
+		}
+	}
+
+	return res
+}
+
+type filterPattern struct {
+	// 0 glob, 1 mime type
+	Kind    uint32
+	Pattern string
+}
+
+// a(ssa(ss)s) entry of the choices option: id, label, the (id, label) choices and the
+// initial one; no choices makes it a boolean, "true" or "false"
+type fileChoice struct {
+	ID      string
+	Label   string
+	Choices []choiceValue
+	Initial string
+}
+
+type choiceValue struct {
+	ID    string
+	Label string
+}
+
+// zenity has no room for extra widgets, every choice answers what it started at as
+// if the user left it alone; a(ss) of id and choice, nil without a choices option
+func choicesResult(logger *log.Logger, options kv) []choiceValue {
+	opt, ok := options["choices"]
+
+	if !ok {
+		return nil
+	}
+
+	var choices []fileChoice
+
+	if err := dbus.Store([]any{opt.Value()}, &choices); err != nil {
+		logger.Println("ignore bad choices:", err)
+
+		return nil
+	}
+
+	res := []choiceValue{}
+
+	for _, c := range choices {
+		answer := c.Initial
+
+		if len(c.Choices) == 0 && answer != "true" {
+			answer = "false"
+		}
+
+		valid := len(c.Choices) == 0
+
+		for _, v := range c.Choices {
+			valid = valid || v.ID == answer
+		}
+
+		if !valid {
+			answer = c.Choices[0].ID
+		}
+
+		res = append(res, choiceValue{c.ID, answer})
+	}
+
+	return res
+}
+
+// a(sa(us)) entry of the filters option, (sa(us)) of current_filter
+type fileFilter struct {
+	Name     string
+	Patterns []filterPattern
+}
+
+var (
+	globsOnce   sync.Once
+	globsByMime map[string][]string
+)
+
+// shared-mime-info globs2 lines are weight:mime:glob[:flags]; a mime type listed in
+// a more important data dir hides its globs from the ones after it
+func loadMimeGlobs() map[string][]string {
+	res := map[string][]string{}
+
+	for _, dir := range dataDirs() {
+		data, err := os.ReadFile(filepath.Join(dir, "mime", "globs2"))
+
+		if err != nil {
+			continue
+		}
+
+		here := map[string]bool{}
+
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Split(line, ":")
+
+			if strings.HasPrefix(line, "#") || len(fields) < 3 || fields[2] == "__NOGLOBS__" {
+				continue
+			}
+
+			mime, glob := fields[1], fields[2]
+
+			if _, earlier := res[mime]; earlier && !here[mime] {
+				continue
+			}
+
+			here[mime] = true
+			res[mime] = append(res[mime], glob)
+		}
+	}
+
+	return res
+}
+
+// globs of a mime type, image/* takes every image type
+func mimeGlobs(mime string) []string {
+	globsOnce.Do(func() {
+		globsByMime = loadMimeGlobs()
+	})
+
+	if prefix, ok := strings.CutSuffix(mime, "/*"); ok {
+		var res []string
+
+		for m, globs := range globsByMime {
+			if strings.HasPrefix(m, prefix+"/") {
+				res = append(res, globs...)
+			}
+		}
+
+		sort.Strings(res)
+
+		return res
+	}
+
+	return globsByMime[mime]
+}
+
+// zenity only knows space separated globs, mime patterns are expanded to their globs
+// and globs with spaces are dropped; a filter left without patterns is skipped, or
+// with PORTAL_FILECHOOSER_EMPTY_FILTER=all matches *
+func resolveFilter(logger *log.Logger, f fileFilter) (fileFilter, bool) {
+	var globs []string
+
+	seen := map[string]bool{}
+
+	for _, pat := range f.Patterns {
+		expanded := []string{pat.Pattern}
+
+		if pat.Kind == 1 {
+			if expanded = mimeGlobs(pat.Pattern); len(expanded) == 0 {
+				logger.Println("filter", f.Name, "drops mime type", pat.Pattern, "with no known globs")
+			}
+		} else if pat.Kind != 0 {
+			expanded = nil
+			logger.Println("filter", f.Name, "drops pattern", pat.Kind, pat.Pattern)
+		}
+
+		for _, glob := range expanded {
+			if glob == "" || strings.ContainsAny(glob, " |") {
+				logger.Println("filter", f.Name, "drops pattern", glob)
+
+				continue
+			}
+
+			if !seen[glob] {
+				seen[glob] = true
+				globs = append(globs, glob)
+			}
+		}
+	}
+
+	if len(globs) == 0 {
+		if config("FILECHOOSER_EMPTY_FILTER", "skip") != "all" {
+			logger.Println("filter", f.Name, "has no usable patterns, skipped")
+
+			return fileFilter{}, false
+		}
+
+		globs = []string{"*"}
+	}
+
+	name := strings.ReplaceAll(f.Name, "|", "/")
+
+	if strings.TrimSpace(name) == "" {
+		name = strings.Join(globs, " ")
+	}
+
+	res := fileFilter{
+		Name: name,
+	}
+
+	for _, glob := range globs {
+		res.Patterns = append(res.Patterns, filterPattern{Pattern: glob})
+	}
+
+	return res, true
+}
+
+func filterArg(f fileFilter) string {
+	var globs []string
+
+	for _, pat := range f.Patterns {
+		globs = append(globs, pat.Pattern)
+	}
+
+	return "--file-filter=" + f.Name + " | " + strings.Join(globs, " ")
+}
+
+// zenity selects the first filter, so current_filter goes first; also returns the
+// filters as applied, for the non standard resolved_filters option
+func filterArgs(logger *log.Logger, options kv) ([]string, []fileFilter) {
+	var filters []fileFilter
+
+	if opt, ok := options["filters"]; ok {
+		if err := dbus.Store([]any{opt.Value()}, &filters); err != nil {
+			logger.Println("ignore bad filters:", err)
+
+			filters = nil
+		}
+	}
+
+	if opt, ok := options["current_filter"]; ok {
+		var current fileFilter
+
+		if err := dbus.Store([]any{opt.Value()}, &current); err != nil {
+			logger.Println("ignore bad current_filter:", err)
+		} else {
+			filters = append([]fileFilter{current}, filters...)
+		}
+	}
+
+	var res []string
+	var applied []fileFilter
+
+	seen := map[string]bool{}
+
+	for _, f := range filters {
+		resolved, ok := resolveFilter(logger, f)
+
+		if !ok {
+			continue
+		}
+
+		if arg := filterArg(resolved); !seen[arg] {
+			seen[arg] = true
+			res = append(res, arg)
+			applied = append(applied, resolved)
+		}
+	}
+
+	return res, applied
+}
+
+// what each FileChooser version adds on top of the previous one, methods and
+// Method.option as the spec documents them
+var fileChooserLevels = [][]string{
+	1: {
+		"OpenFile", "OpenFile.accept_label", "OpenFile.multiple", "OpenFile.filters", "OpenFile.current_filter", "OpenFile.choices",
+		"SaveFile", "SaveFile.accept_label", "SaveFile.filters", "SaveFile.current_filter", "SaveFile.choices",
+		"SaveFile.current_name", "SaveFile.current_folder", "SaveFile.current_file",
+	},
+	2: {"SaveFiles", "SaveFiles.accept_label", "SaveFiles.choices", "SaveFiles.current_folder", "SaveFiles.files"},
+	3: {"OpenFile.directory"},
+	4: {"OpenFile.current_folder"},
+}
+
+// a method is handled when FileChooser has it, an option when knownOptions lists it
+func fileChooserHandles(feature string) bool {
+	method, option, hasOption := strings.Cut(feature, ".")
+
+	if !reflect.ValueOf(&FileChooser{}).MethodByName(method).IsValid() {
+		return false
+	}
+
+	if !hasOption {
+		return true
+	}
+
+	for _, key := range knownOptions["FileChooser."+method] {
+		if key == option {
+			return true
+		}
+	}
+
+	return false
+}
+
+// the highest version whose features, and all before it, are handled;
+// never below 1 while the interface is exported at all
+func fileChooserVersion() uint32 {
+	version := uint32(1)
+
+	for v := 1; v < len(fileChooserLevels); v++ {
+		for _, f := range fileChooserLevels[v] {
+			if !fileChooserHandles(f) {
+				return version
+			}
+		}
+
+		version = uint32(v)
+	}
+
+	return version
+}
+
+// accept_label wins, otherwise the button says what the dialog does;
+// labels carry a mnemonic underscore like the ones clients send
+func acceptLabel(method string, options kv) string {
+	if label, _ := options["accept_label"].Value().(string); label != "" {
+		return label
+	}
+
+	if directory, _ := options["directory"].Value().(bool); directory && method == "OpenFile" {
+		return "_Select"
+	}
+
+	if method == "SaveFile" || method == "SaveFiles" {
+		return "_Save"
+	}
+
+	return "_Open"
+}
+
+// what a FileChooser call asked for, args are the zenity arguments built from it
+type dialogCall struct {
+	ctx      context.Context
+	method   string
+	app      string
+	title    string
+	options  kv
+	args     []string
+	multiple bool
+	metadata bool
+	// filters given to the dialog, see filterArgs
+	filters  []fileFilter
+	// SaveFiles names, the dialog then picks the folder they go to
+	files    []string
+}
+
+// zenity prints the chosen paths, or exits 1 on cancel
+func (p *FileChooser) dialog(req *request, logger *log.Logger, call *dialogCall) {
+	var paths []string
+
+	method, app, args := call.method, call.app, call.args
+
+	if path := autoAnswer(method); path != "" {
+		logger.Println("auto answer", path)
+
+		req.setBackend("autoanswer")
+
+		paths = []string{path}
+	} else if plugin := expandCommand(config("FILECHOOSER_PLUGIN", "")); plugin != "" {
+		req.setBackend(plugin)
+
+		code, res, err := runPlugin(call.ctx, plugin, call)
+
+		if err != nil {
+			code, reason := exitResponse(plugin, err)
+			logger.Println(reason)
+			req.response(code, kv{})
+
+			return
+		}
+
+		if code != 0 || len(res) == 0 {
+			logger.Println("plugin answered", code, "with", len(res), "files")
+
+			if code == 0 {
+				code = 1
+			}
+
+			req.response(code, kv{})
+
+			return
+		}
+
+		paths = res
+	} else {
+		// file names may hold newlines or anything else but NUL, which argv can not carry;
+		// a per call random sentinel can not collide with a real name in practice
+		sep := selectionSeparator()
+
+		if call.multiple {
+			args = append(args, "--multiple", "--separator="+sep)
+		}
+
+		logger.Println("run zenity", args)
+
+		backend := "zenity"
+
+		if v, _ := capability("filechooser-version").(string); v != "" {
+			backend += " " + v
+		}
+
+		req.setBackend(backend)
+
+		cmd := helperCommand(call.ctx, "zenity", args...)
+		cmd.Env = dialogEnv()
+
+		pat, err := cmd.Output()
+
+		if err != nil {
+			code, reason := exitResponse("zenity", err)
+			logger.Println(reason)
+			req.response(code, kv{})
+
+			return
+		}
+
+		// only the newline zenity appends, names may end in blanks
+		paths = strings.Split(strings.TrimSuffix(string(pat), "\n"), sep)
+
+		logger.Println("selected", len(paths), "files")
+	}
+
+	// SaveFiles picked a folder, the answer is each file in it
+	if len(call.files) > 0 {
+		dir := paths[0]
+		paths = nil
+
+		for _, name := range call.files {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+	}
+
+	var uris []string
+
+	err := try(func() {
+		paths = capSelection(logger, paths)
+
+		for _, path := range paths {
+			uris = append(uris, fileURI(path))
+		}
+	})
+
+	if err != nil {
+		logger.Println(err.what())
+		req.response(2, kv{})
+
+		return
+	}
+
+	lastFolders.set(app, filepath.Dir(paths[0]))
+
+	results := kv{
+		"uris": dbus.MakeVariant(uris),
+	}
+
+	if call.metadata {
+		results["metadata"] = dbus.MakeVariant(fileMetadata(logger, paths))
+	}
+
+	if choices := choicesResult(logger, call.options); choices != nil {
+		results["choices"] = dbus.MakeVariant(choices)
+	}
+
+	// additive, for client developers wondering where their mime filters went
+	if echo, _ := call.options["resolved_filters"].Value().(bool); echo {
+		results["resolved_filters"] = dbus.MakeVariant(call.filters)
+	}
+
+	req.response(0, results)
+}
+
+func (p *FileChooser) OpenFile(sender dbus.Sender, parent string, title string, options kv) (dbus.ObjectPath, *dbus.Error) {
+	token, id := handleToken(options), correlationID()
+	logger := newLogger("OpenFile", sender, token, id)
+
+	logger.Println("enter", parent, title, options)
+
+	if err := disabled("FileChooser.OpenFile"); err != nil {
+		return "", err
+	}
+
+	if err := checkOptions("FileChooser.OpenFile", options); err != nil {
+		return "", err
+	}
+
+	req, err := newRequest(p.portal, "FileChooser.OpenFile", string(sender), token, id)
+
+	if err != nil {
+		return "", err
+	}
+
+	traceCall(req, options, title)
+
+	go func() {
+		try(func() {
+			app := appID(p.portal.conn, string(sender))
+			args := []string{"--file-selection", "--title=" + title, "--ok-label=" + acceptLabel("OpenFile", options)}
+
+			if dir := startFolder(options, app); dir != "" {
+				args = append(args, "--filename="+strings.TrimSuffix(dir, "/")+"/")
+			}
+
+			if directory, _ := options["directory"].Value().(bool); directory {
+				args = append(args, "--directory")
+			}
+
+			fargs, filters := filterArgs(logger, options)
+			args = append(args, fargs...)
+
+			multiple, _ := options["multiple"].Value().(bool)
+			// additive, asked for by upload dialogs
+			metadata, _ := options["metadata"].Value().(bool)
+
+			ctx, cancel := context.WithTimeout(req.ctx, methodTimeout("FileChooser", options))
+			defer cancel()
+
+			p.dialog(req, logger, &dialogCall{
+				ctx:      ctx,
+				method:   "OpenFile",
+				app:      app,
+				title:    title,
+				options:  options,
+				args:     args,
+				multiple: multiple,
+				metadata: metadata,
+				filters:  filters,
+			})
+		}).catch(func(exc *Exception) {
+			logger.Println(exc.what())
+		})
+	}()
+
+	return req.path, nil
+}
+
+func (p *FileChooser) SaveFile(sender dbus.Sender, parent string, title string, options kv) (dbus.ObjectPath, *dbus.Error) {
+	token, id := handleToken(options), correlationID()
+	logger := newLogger("SaveFile", sender, token, id)
+
+	logger.Println("enter", parent, title, options)
+
+	if err := disabled("FileChooser.SaveFile"); err != nil {
+		return "", err
+	}
+
+	if err := checkOptions("FileChooser.SaveFile", options); err != nil {
+		return "", err
+	}
+
+	req, err := newRequest(p.portal, "FileChooser.SaveFile", string(sender), token, id)
+
+	if err != nil {
+		return "", err
+	}
+
+	traceCall(req, options, title)
+
+	go func() {
+		try(func() {
+			app := appID(p.portal.conn, string(sender))
+			args := []string{"--file-selection", "--save", "--title=" + title, "--ok-label=" + acceptLabel("SaveFile", options)}
+
+			if file := bytesOption(options, "current_file"); file != "" {
+				args = append(args, "--filename="+expandTilde(file))
+			} else if name, _ := options["current_name"].Value().(string); expandTilde(name) != name {
+				args = append(args, "--filename="+expandTilde(name))
+			} else if dir := startFolder(options, app); name != "" {
+				args = append(args, "--filename="+filepath.Join(dir, name))
+			} else if dir != "" {
+				// nothing to prefill, the trailing slash opens zenity in the folder
+				args = append(args, "--filename="+strings.TrimSuffix(dir, "/")+"/")
+			}
+
+			fargs, filters := filterArgs(logger, options)
+			args = append(args, fargs...)
+
+			ctx, cancel := context.WithTimeout(req.ctx, methodTimeout("FileChooser", options))
+			defer cancel()
+
+			p.dialog(req, logger, &dialogCall{
+				ctx:     ctx,
+				method:  "SaveFile",
+				app:     app,
+				title:   title,
+				options: options,
+				args:    args,
+				filters: filters,
+			})
+		}).catch(func(exc *Exception) {
+			logger.Println(exc.what())
+		})
+	}()
+
+	return req.path, nil
+}
+
+// the files option, aay of NUL terminated names; only base names, a client can
+// not steer the save outside the folder the user picks
+func saveFilesNames(options kv) ([]string, *dbus.Error) {
+	opt, ok := options["files"]
+
+	if !ok {
+		return nil, invalidArgument("SaveFiles needs a files option")
+	}
+
+	list, ok := opt.Value().([][]byte)
+
+	if !ok {
+		return nil, invalidArgument("files is %s, want aay", opt.Signature())
+	}
+
+	if len(list) == 0 {
+		return nil, invalidArgument("SaveFiles with an empty files list")
+	}
+
+	var res []string
+
+	for _, raw := range list {
+		name := strings.TrimRight(string(raw), "\x00")
+
+		if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+			return nil, invalidArgument("bad file name %q in files", name)
+		}
+
+		res = append(res, name)
+	}
+
+	return res, nil
+}
+
+func (p *FileChooser) SaveFiles(sender dbus.Sender, parent string, title string, options kv) (dbus.ObjectPath, *dbus.Error) {
+	token, id := handleToken(options), correlationID()
+	logger := newLogger("SaveFiles", sender, token, id)
+
+	logger.Println("enter", parent, title, options)
+
+	if err := disabled("FileChooser.SaveFiles"); err != nil {
+		return "", err
+	}
+
+	if err := checkOptions("FileChooser.SaveFiles", options); err != nil {
+		return "", err
+	}
+
+	files, err := saveFilesNames(options)
+
+	if err != nil {
+		return "", err
+	}
+
+	req, err := newRequest(p.portal, "FileChooser.SaveFiles", string(sender), token, id)
+
+	if err != nil {
+		return "", err
+	}
+
+	traceCall(req, options, title)
+
+	go func() {
+		try(func() {
+			app := appID(p.portal.conn, string(sender))
+			args := []string{"--file-selection", "--directory", "--title=" + title, "--ok-label=" + acceptLabel("SaveFiles", options)}
+
+			if dir := startFolder(options, app); dir != "" {
+				args = append(args, "--filename="+strings.TrimSuffix(dir, "/")+"/")
+			}
+
+			ctx, cancel := context.WithTimeout(req.ctx, methodTimeout("FileChooser", options))
+			defer cancel()
+
+			p.dialog(req, logger, &dialogCall{
+				ctx:     ctx,
+				method:  "SaveFiles",
+				app:     app,
+				title:   title,
+				options: options,
+				args:    args,
+				files:   files,
+			})
+		}).catch(func(exc *Exception) {
+			logger.Println(exc.what())
+		})
+	}()
+
+	return req.path, nil
+}
+
+type Settings struct {
+	portal  *portal
+	lock    sync.Mutex
+	pending map[*setting]bool
+}
+
+func box(v interface{}) *dbus.Variant {
+	if v == nil {
+		return nil
+	}
+
+	res := dbus.MakeVariant(v)
+
+	return &res
+}
+
+// 0 no preference, 1 prefer dark, 2 prefer light
+func colorScheme() uint32 {
+	return 1
+}
+
+// PORTAL_REDUCED_MOTION=0|1 wins, otherwise gnome enable-animations decides
+func enableAnimations() bool {
+	switch config("REDUCED_MOTION", "") {
+	case "1":
+		return false
+	case "0":
+		return true
+	case "":
+	default:
+		log.Println("ignore bad PORTAL_REDUCED_MOTION, want 0 or 1")
+	}
+
+	val, _ := gsettings("org.gnome.desktop.interface", "enable-animations")
+
+	return val != "false"
+}
+
+// 0 no preference, 1 reduced
+func reducedMotion() uint32 {
+	if enableAnimations() {
+		return 0
+	}
+
+	return 1
+}
+
+type setting struct {
+	namespace string
+	key       string
+	value     func() any
+	// dconf keys the value is derived from
+	dconf     []string
+}
+
+var settings = []setting{
+	{"org.freedesktop.appearance", "color-scheme", func() any { return colorScheme() }, nil},
+	{"org.freedesktop.appearance", "accent-color", func() any { return accentColor() }, []string{
+		"/org/gnome/desktop/interface/accent-color",
+		"/org/gnome/desktop/interface/gtk-theme",
+	}},
+	{"org.freedesktop.appearance", "reduced-motion", func() any { return reducedMotion() }, []string{
+		"/org/gnome/desktop/interface/enable-animations",
+	}},
+	{"org.gnome.desktop.interface", "enable-animations", func() any { return enableAnimations() }, []string{
+		"/org/gnome/desktop/interface/enable-animations",
+	}},
+	// runtime capabilities of this portal
+	{extNamespace, "interfaces", func() any { return capability("interfaces") }, nil},
+	{extNamespace, "disabled-methods", func() any { return capability("disabled-methods") }, nil},
+	{extNamespace, "open-backend", func() any { return capability("open-backend") }, nil},
+	{extNamespace, "filechooser-backend", func() any { return capability("filechooser-backend") }, nil},
+	{extNamespace, "screenshot-backend", func() any { return capability("screenshot-backend") }, nil},
+}
+
+var capabilityProbes = map[string]func() any{
+	"interfaces":          func() any { return exportedInterfaces() },
+	"disabled-methods":    func() any { return disabledMethods() },
+	"open-backend":        func() any { return activeOpenBackend() },
+	"filechooser-backend": func() any { return activeDialogBackend() },
+	"screenshot-backend":  func() any { return activeScreenshotBackend() },
+	"filechooser-version": func() any { return dialogVersion() },
+}
+
+// zenity is the one dialog backend with a version worth reporting
+func dialogVersion() string {
+	if activeDialogBackend() != "zenity" {
+		return ""
+	}
+
+	v, _ := zenityInfo()
+
+	return v
+}
+
+// an immutable snapshot, reprobe swaps in a new one so reads take no lock
+// and never see half a refresh
+type capabilities map[string]any
+
+var caps atomic.Pointer[capabilities]
+
+func probeCapabilities() *capabilities {
+	res := capabilities{}
+
+	for key, probe := range capabilityProbes {
+		res[key] = probe()
+	}
+
+	return &res
+}
+
+func capability(key string) any {
+	c := caps.Load()
+
+	if c == nil {
+		caps.CompareAndSwap(nil, probeCapabilities())
+		c = caps.Load()
+	}
+
+	return (*c)[key]
+}
+
+func (s *setting) dependsOn(changed string) bool {
+	for _, key := range s.dconf {
+		if key == changed || (strings.HasSuffix(changed, "/") && strings.HasPrefix(key, changed)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Settings) emit(s *setting) {
+	err := p.portal.conn.Emit(desktopPath, "org.freedesktop.portal.Settings.SettingChanged", s.namespace, s.key, dbus.MakeVariant(s.value()))
+
+	if err != nil {
+		fmtException("can not emit SettingChanged: %w", err).throw()
+	}
+}
+
+func coalesceWindow() time.Duration {
+	window, err := time.ParseDuration(config("SETTINGS_COALESCE", "100ms"))
+
+	if err != nil {
+		log.Println("bad PORTAL_SETTINGS_COALESCE, do not coalesce:", err)
+
+		return 0
+	}
+
+	return window
+}
+
+// a theme switch touches several keys at once, the first change opens a
+// PORTAL_SETTINGS_COALESCE window and everything changed within it goes out in one burst
+func (p *Settings) changed(s *setting) {
+	window := coalesceWindow()
+
+	if window <= 0 {
+		p.emit(s)
+
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.pending == nil {
+		p.pending = map[*setting]bool{}
+
+		time.AfterFunc(window, p.flush)
+	}
+
+	p.pending[s] = true
+}
+
+func (p *Settings) flush() {
+	p.lock.Lock()
+	pending := p.pending
+	p.pending = nil
+	p.lock.Unlock()
+
+	var keys []string
+
+	for i := range settings {
+		if s := &settings[i]; pending[s] {
+			keys = append(keys, s.namespace+"."+s.key)
+
+			try(func() {
+				p.emit(s)
+			}).catch(func(exc *Exception) {
+				log.Println("in flush", exc.what())
+			})
+		}
+	}
+
+	log.Println("emitted SettingChanged for", keys)
+}
+
+// every dconf backed setting subscribes on its own, watchers coalesce the match rules
+func (p *Settings) watch() []func() {
+	var res []func()
+
+	for i := range settings {
+		s := &settings[i]
+
+		if len(s.dconf) == 0 {
+			continue
+		}
+
+		res = append(res, p.portal.watchers.watch(dconfNotify, func(sig *dbus.Signal) {
+			// before changed, whose emit re-reads the value
+			gsettingsReads.invalidate()
+
+			for _, key := range dconfKeys(sig) {
+				if s.dependsOn(key) {
+					p.changed(s)
+
+					return
+				}
+			}
+		}))
+	}
+
+	return res
+}
+
+var (
+	settingNamespace = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+	settingKey       = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// a malformed name is a bad request, not an unknown setting
+func validSettingName(namespace string, key string) *dbus.Error {
+	if !settingNamespace.MatchString(namespace) {
+		return invalidArgument("bad settings namespace %q", namespace)
+	}
+
+	if !settingKey.MatchString(key) {
+		return invalidArgument("bad settings key %q", key)
+	}
+
+	return nil
+}
+
+func (p *Settings) ReadOne(sender dbus.Sender, namespace string, key string) (*dbus.Variant, *dbus.Error) {
+	log.Println("enter ReadOne", sender, namespace, key)
+
+	if err := validSettingName(namespace, key); err != nil {
+		return nil, err
+	}
+
+	for _, s := range settings {
+		if s.namespace == namespace && s.key == key {
+			return box(s.value()), nil
+		}
+	}
+
+	return nil, &dbus.ErrMsgNoObject
+}
+
+// namespace patterns may end with *, none or "" match everything
+func namespaceMatches(patterns []string, namespace string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pat := range patterns {
+		if pat == "" || pat == namespace {
+			return true
+		}
+
+		if prefix, ok := strings.CutSuffix(pat, "*"); ok && strings.HasPrefix(namespace, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Settings) ReadAll(sender dbus.Sender, namespaces []string) (map[string]map[string]dbus.Variant, *dbus.Error) {
+	log.Println("enter ReadAll", sender, namespaces)
+
+	res := map[string]map[string]dbus.Variant{}
+
+	for _, s := range settings {
+		if !namespaceMatches(namespaces, s.namespace) {
+			continue
+		}
+
+		if res[s.namespace] == nil {
+			res[s.namespace] = map[string]dbus.Variant{}
+		}
+
+		res[s.namespace][s.key] = dbus.MakeVariant(s.value())
+	}
+
+	return res, nil
+}
+
+func (p *Settings) Read(sender dbus.Sender, namespace string, key string) (*dbus.Variant, *dbus.Error) {
+	res, err := p.ReadOne(sender, namespace, key)
+
+	return box(res), err
+}
+
+// "held by :1.5 (PID 1234, xdg-desktop-portal)", best effort
+func describeOwner(conn *dbus.Conn, service string) string {
+	var owner string
+
+	if err := conn.BusObject().Call("org.freedesktop.DBus.GetNameOwner", 0, service).Store(&owner); err != nil {
+		return "owner unknown: " + err.Error()
+	}
+
+	res := "held by " + owner
+
+	try(func() {
+		pid := callerPid(conn, owner)
+		comm, _ := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+
+		res += fmt.Sprintf(" (PID %d, %s)", pid, strings.TrimSpace(string(comm)))
+	}).catch(func(exc *Exception) {
+		log.Println("in describeOwner", exc.what())
+	})
+
+	return res
+}
+
+// PORTAL_ON_NAME_TAKEN is fail (default) or replace, --replace forces replace
+func nameFlags(replace bool) dbus.RequestNameFlags {
+	// whoever comes next with --replace may take over from us
+	flags := dbus.NameFlagDoNotQueue | dbus.NameFlagAllowReplacement
+
+	switch policy := config("ON_NAME_TAKEN", "fail"); {
+	case replace || policy == "replace":
+		flags |= dbus.NameFlagReplaceExisting
+	case policy != "fail":
+		fmtException("bad PORTAL_ON_NAME_TAKEN %s, want fail or replace", policy).withCode(exitConfig).throw()
+	}
+
+	return flags
+}
+
+func bind(conn *dbus.Conn, service string, flags dbus.RequestNameFlags) {
+	reply, err := conn.RequestName(service, flags)
+
+	if err != nil {
+		fmtException("can not request name %s: %w", service, err).throw()
+	}
+
+	if reply == dbus.RequestNameReplyPrimaryOwner {
+		return
+	}
+
+	if flags&dbus.NameFlagReplaceExisting != 0 {
+		fmtException("name %s not handed over, owner refused to yield, %s", service, describeOwner(conn, service)).withCode(exitNameTaken).throw()
+	}
+
+	fmtException("name %s already taken, %s", service, describeOwner(conn, service)).withCode(exitNameTaken).throw()
+}
+
+// exit once a --replace instance took the name from us
+func (p *portal) watchNameLost(service string) func() {
+	// from the bus only, anyone else can send us a NameLost directly
+	rule := matchRule{
+		sender: busName,
+		iface:  "org.freedesktop.DBus",
+		member: "NameLost",
+		path:   "/org/freedesktop/DBus",
+	}
+
+	return p.watchers.watch(rule, func(sig *dbus.Signal) {
+		if len(sig.Body) == 0 {
+			return
+		}
+
+		if name, _ := sig.Body[0].(string); name == service {
+			log.Println("lost", service, "to a replacement, exit")
+			exit(0)
+		}
+	})
+}
+
+func sessionBus() *dbus.Conn {
+	conn, err := dbus.ConnectSessionBus()
+
+	if err != nil {
+		fmtException("can not connect session bus %w", err).withCode(exitNoBus).throw()
+	}
+
+	return conn
+}
+
+type export struct {
+	iface   string
+	// 0 for interfaces without a version property
+	version uint32
+	obj     any
+}
+
+// exported objects with properties beyond version
+type propertied interface {
+	properties() map[string]*prop.Prop
+}
+
+func (p *portal) exports(st *Settings) []export {
+	return []export{
+		{"org.freedesktop.portal.OpenURI", 4, &OpenURI{portal: p}},
+		{extNamespace + ".OpenURI", 0, &OpenURIExt{portal: p}},
+		{"org.freedesktop.portal.FileChooser", fileChooserVersion(), &FileChooser{portal: p}},
+		{"org.freedesktop.portal.Account", 1, &Account{portal: p}},
+		{"org.freedesktop.portal.Screenshot", 1, &Screenshot{portal: p}},
+		{"org.freedesktop.portal.Settings", 1, st},
+		{extNamespace + ".Debug", 0, &Debug{}},
+	}
+}
+
+func exportedInterfaces() []string {
+	var res []string
+
+	dropins := interfaceDropins()
+
+	for _, e := range (&portal{}).exports(nil) {
+		if interfaceEnabled(dropins, e.iface) && unhealthy(e.iface) == "" {
+			res = append(res, e.iface)
+		}
+	}
+
+	return res
+}
+
+// (re)export the interfaces enabled by drop-ins, disabled or unhealthy ones are unexported
+func (p *portal) publish(st *Settings) {
+	dropins := interfaceDropins()
+	props := map[string]map[string]*prop.Prop{}
+
+	checkZenity()
+
+	for _, e := range p.exports(st) {
+		if !interfaceEnabled(dropins, e.iface) {
+			log.Println("interface", e.iface, "disabled by drop-in")
+			p.conn.Export(nil, desktopPath, e.iface)
+
+			continue
+		}
+
+		if unhealthy(e.iface) != "" {
+			p.conn.Export(nil, desktopPath, e.iface)
+
+			continue
+		}
+
+		if err := p.conn.ExportMethodTable(p.guard(e.obj), desktopPath, e.iface); err != nil {
+			fmtException("can not export %s: %w", e.iface, err).throw()
+		}
+
+		if e.version != 0 {
+			props[e.iface] = map[string]*prop.Prop{
+				"version": {
+					Value: e.version,
+				},
+			}
+		}
+
+		if pr, ok := e.obj.(propertied); ok {
+			props[e.iface] = pr.properties()
+		}
+	}
+
+	if _, err := prop.Export(p.conn, desktopPath, props); err != nil {
+		fmtException("can not bind properties: %w", err).throw()
+	}
+
+	p.versionsChanged(props)
+}
+
+// a republish may bring an interface back or change what it advertises,
+// clients caching the version hear about it
+func (p *portal) versionsChanged(props map[string]map[string]*prop.Prop) {
+	versions := map[string]uint32{}
+
+	for iface, pr := range props {
+		if v, ok := pr["version"]; ok {
+			versions[iface], _ = v.Value.(uint32)
+		}
+	}
+
+	old := p.versions
+	p.versions = versions
+
+	if old == nil {
+		return
+	}
+
+	for iface, v := range versions {
+		if old[iface] == v {
+			continue
+		}
+
+		log.Println("interface", iface, "version changed from", old[iface], "to", v)
+
+		err := p.conn.Emit(desktopPath, "org.freedesktop.DBus.Properties.PropertiesChanged", iface, map[string]dbus.Variant{"version": dbus.MakeVariant(v)}, []string{})
+
+		if err != nil {
+			log.Println("can not emit PropertiesChanged:", err)
+		}
+	}
+}
+
+// capabilities are served from the last probe, a tool installed after startup
+// only shows up to clients when a probe notices and announces it
+func (p *Settings) reprobe() {
+	old := caps.Swap(probeCapabilities())
+
+	if old == nil {
+		return
+	}
+
+	for i := range settings {
+		s := &settings[i]
+
+		if s.namespace != extNamespace {
+			continue
+		}
+
+		was, val := fmt.Sprint((*old)[s.key]), fmt.Sprint(s.value())
+
+		if was != val {
+			log.Println("capability", s.key, "changed from", was, "to", val)
+			p.changed(s)
+		}
+	}
+}
+
+// SIGHUP republishes interfaces from drop-ins and fresh probes, re-probes capabilities and
+// retries a read only state dir; PORTAL_REPROBE_INTERVAL (off by default) does so periodically
+func (p *portal) reloader(st *Settings) func() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	var ticker *time.Ticker
+
+	if interval, err := time.ParseDuration(config("REPROBE_INTERVAL", "0s")); err != nil {
+		log.Println("bad PORTAL_REPROBE_INTERVAL, ignored:", err)
+	} else if interval > 0 {
+		ticker = time.NewTicker(interval)
+		tick = ticker.C
+	}
+
+	stop := make(chan struct{})
+
+	st.reprobe()
+
+	go func() {
+		for {
+			select {
+			case <-hup:
+				log.Println("SIGHUP, reload interface drop-ins")
+			case <-tick:
+			case <-stop:
+				return
+			}
+
+			// a tool installed since the last probe may make an interface servable
+			try(func() {
+				p.publish(st)
+			}).catch(func(exc *Exception) {
+				log.Println("in reload", exc.what())
+			})
+
+			lastFolders.retry()
+
+			try(st.reprobe).catch(func(exc *Exception) {
+				log.Println("in reprobe", exc.what())
+			})
+		}
+	}()
+
+	return func() {
+		signal.Stop(hup)
+
+		if ticker != nil {
+			ticker.Stop()
+		}
+
+		close(stop)
+	}
+}
+
+func newPortal(conn *dbus.Conn, opener func(string, openOptions) openResult) *portal {
+	return &portal{
+		conn:     conn,
+		watchers: newWatchers(conn),
+		requests: map[dbus.ObjectPath]*request{},
+		opener:   opener,
+	}
+}
+
+// export everything on conn and take the portal name, returned func drains requests and tears down watchers
+func serve(conn *dbus.Conn, opener func(string, openOptions) openResult, flags dbus.RequestNameFlags) func() {
+	return newPortal(conn, opener).serve(flags)
+}
+
+func (p *portal) serve(flags dbus.RequestNameFlags) func() {
+	st := &Settings{
+		portal: p,
+	}
+
+	p.publish(st)
+
+	unwatch := st.watch()
+	unwatch = append(unwatch, p.reloader(st))
+	unwatch = append(unwatch, p.watchNameLost("org.freedesktop.portal.Desktop"))
+
+	bind(p.conn, "org.freedesktop.portal.Desktop", flags)
+
+	return func() {
+		p.drain()
+
+		for _, cb := range unwatch {
+			cb()
+		}
+	}
+}
+
+func run(replace bool) {
+	conn := sessionBus()
+	defer conn.Close()
+
+	defer serve(conn, xdgOpen, nameFlags(replace))()
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
 
-	select {}
+	log.Println(<-term, "received, shut down")
 }
 
 func main() {
-	try(run).catch(func(exc *Exception) {
-		exc.fatal(1, "abort")
+	try(func() {
+		cli(os.Args[1:])
+	}).catch(func(exc *Exception) {
+		exc.fatal(exitFailure, "abort")
 	})
 }
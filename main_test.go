@@ -0,0 +1,2431 @@
+package main
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+	"bytes"
+	"errors"
+	"context"
+	"syscall"
+	"os/exec"
+	"os/user"
+	"strings"
+	"testing"
+	"sync/atomic"
+	"path/filepath"
+	"github.com/godbus/dbus/v5"
+)
+
+var quiet = log.New(io.Discard, "", 0)
+
+// an executable sh script in dir, for fake helpers on PATH
+func writeScript(t *testing.T, dir string, name string, body string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// HOME and the XDG dirs in a temp dir, so nothing reads or writes the real ones
+func isolate(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	t.Setenv("HOME", dir)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "config"))
+	t.Setenv("XDG_STATE_HOME", filepath.Join(dir, "state"))
+	t.Setenv("XDG_DATA_HOME", filepath.Join(dir, "data"))
+	t.Setenv("XDG_DATA_DIRS", filepath.Join(dir, "share"))
+
+	return dir
+}
+
+// a portal on a private bus and a client of it, torn down with the test
+type testBus struct {
+	portal  *portal
+	client  *dbus.Conn
+	obj     dbus.BusObject
+	signals chan *dbus.Signal
+	addr    string
+	stop    func()
+}
+
+// a dbus-daemon of the test's own, skipped where there is none
+func testBusAddr(t *testing.T) string {
+	t.Helper()
+
+	if _, err := exec.LookPath("dbus-daemon"); err != nil {
+		t.Skip("no dbus-daemon")
+	}
+
+	var addr string
+
+	exc := try(func() {
+		var stop func()
+
+		addr, stop = privateBus()
+		t.Cleanup(stop)
+	})
+
+	if exc != nil {
+		t.Fatal(exc.what())
+	}
+
+	return addr
+}
+
+func testConn(t *testing.T, addr string) *dbus.Conn {
+	t.Helper()
+
+	conn, err := dbus.Connect(addr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	return conn
+}
+
+func startPortal(t *testing.T, opener func(string, openOptions) openResult) *testBus {
+	t.Helper()
+
+	addr := testBusAddr(t)
+
+	isolate(t)
+
+	b := &testBus{
+		signals: make(chan *dbus.Signal, 16),
+		addr:    addr,
+	}
+
+	b.portal = newPortal(testConn(t, addr), opener)
+
+	exc := try(func() {
+		var once sync.Once
+
+		teardown := b.portal.serve(dbus.NameFlagDoNotQueue)
+
+		b.stop = func() {
+			once.Do(teardown)
+		}
+	})
+
+	if exc != nil {
+		t.Fatal(exc.what())
+	}
+
+	t.Cleanup(b.stop)
+
+	b.client = testConn(t, addr)
+	b.obj = b.client.Object("org.freedesktop.portal.Desktop", desktopPath)
+
+	err := b.client.AddMatchSignal(dbus.WithMatchInterface("org.freedesktop.portal.Request"), dbus.WithMatchMember("Response"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.client.Signal(b.signals)
+
+	return b
+}
+
+func (b *testBus) openURI(token string, uri string) (dbus.ObjectPath, error) {
+	var handle dbus.ObjectPath
+
+	options := kv{
+		"handle_token": dbus.MakeVariant(token),
+	}
+
+	err := b.obj.Call("org.freedesktop.portal.OpenURI.OpenURI", 0, "", uri, options).Store(&handle)
+
+	return handle, err
+}
+
+func (b *testBus) response(t *testing.T, handle dbus.ObjectPath, wait time.Duration) (uint32, map[string]dbus.Variant, bool) {
+	t.Helper()
+
+	timeout := time.After(wait)
+
+	for {
+		select {
+		case sig := <-b.signals:
+			if sig.Path != handle {
+				continue
+			}
+
+			code, _ := sig.Body[0].(uint32)
+			results, _ := sig.Body[1].(map[string]dbus.Variant)
+
+			return code, results, true
+		case <-timeout:
+			return 0, nil, false
+		}
+	}
+}
+
+func (b *testBus) live() int {
+	b.portal.lock.Lock()
+	defer b.portal.lock.Unlock()
+
+	return len(b.portal.requests)
+}
+
+// an opener that holds every open until release is closed
+func blockingOpener() (func(string, openOptions) openResult, chan string, chan struct{}) {
+	opened := make(chan string, 4)
+	release := make(chan struct{})
+
+	return func(uri string, opts openOptions) openResult {
+		opened <- uri
+		<-release
+
+		return openResult{handler: "test"}
+	}, opened, release
+}
+
+func dbusErrorName(err error) string {
+	var e dbus.Error
+
+	if errors.As(err, &e) {
+		return e.Name
+	}
+
+	return ""
+}
+
+func openFds(t *testing.T) int {
+	t.Helper()
+
+	fds, err := os.ReadDir("/proc/self/fd")
+
+	if err != nil {
+		t.Skip("no /proc/self/fd")
+	}
+
+	return len(fds)
+}
+
+func TestFdPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "doc.txt")
+
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := syscall.Dup(int(f.Fd()))
+
+	f.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fdPath(dbus.UnixFD(fd)); got != path {
+		t.Errorf("fdPath = %s, want %s", got, path)
+	}
+
+	// consumed
+	var st syscall.Stat_t
+
+	if err := syscall.Fstat(fd, &st); err == nil {
+		t.Error("fdPath left the fd open")
+	}
+
+	for _, bad := range []dbus.UnixFD{-1, 1000} {
+		if exc := try(func() { fdPath(bad) }); exc == nil {
+			t.Errorf("fdPath(%d) did not fail", bad)
+		}
+	}
+}
+
+func TestOpenFileFd(t *testing.T) {
+	opened := make(chan string, 1)
+
+	b := startPortal(t, func(uri string, opts openOptions) openResult {
+		opened <- uri
+
+		return openResult{}
+	})
+
+	path := filepath.Join(t.TempDir(), "doc.txt")
+
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	before := openFds(t)
+
+	for i := 0; i < 20; i++ {
+		f, err := os.Open(path)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var handle dbus.ObjectPath
+
+		err = b.obj.Call("org.freedesktop.portal.OpenURI.OpenFile", 0, "", dbus.UnixFD(f.Fd()), kv{}).Store(&handle)
+
+		f.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code, _, ok := b.response(t, handle, 5*time.Second); !ok || code != 0 {
+			t.Fatalf("OpenFile answered %d, %v", code, ok)
+		}
+
+		if uri := <-opened; uri != fileURI(path) {
+			t.Errorf("opened %s, want %s", uri, fileURI(path))
+		}
+	}
+
+	if after := openFds(t); after != before {
+		t.Errorf("%d fds open after 20 OpenFile calls, %d before", after, before)
+	}
+
+	// a descriptor that is not open, as one closed before the portal got to it
+	msg := dbus.Message{
+		Headers: map[dbus.HeaderField]dbus.Variant{
+			dbus.FieldUnixFDs: dbus.MakeVariant(uint32(1)),
+		},
+	}
+
+	handle, derr := (&OpenURI{portal: b.portal}).OpenFile(dbus.Sender(b.client.Names()[0]), msg, "", 1000, kv{})
+
+	if derr != nil {
+		t.Fatal(derr)
+	}
+
+	if code, _, ok := b.response(t, handle, 5*time.Second); !ok || code != 2 {
+		t.Errorf("closed fd answered %d, %v, want 2", code, ok)
+	}
+}
+
+func TestOpenFileNoFds(t *testing.T) {
+	b := startPortal(t, nil)
+
+	before := b.live()
+
+	// no fd came with the call at all, the index points at nothing
+	_, derr := (&OpenURI{portal: b.portal}).OpenFile(dbus.Sender(b.client.Names()[0]), dbus.Message{}, "", 0, kv{})
+
+	if derr == nil || derr.Name != "org.freedesktop.portal.Error.InvalidArgument" {
+		t.Errorf("OpenFile without fds: %v, want InvalidArgument", derr)
+	}
+
+	if n := b.live(); n != before {
+		t.Errorf("%d requests after a refused OpenFile, want %d", n, before)
+	}
+}
+
+func TestCheckOpenDepth(t *testing.T) {
+	t.Setenv("PORTAL_URI_SCHEMES", "")
+	t.Setenv("PORTAL_MAX_DEPTH", "2")
+
+	for depth, refused := range map[int]bool{0: false, 1: false, 2: true, 5: true} {
+		exc := try(func() {
+			checkOpen("https://example.org/", depth)
+		})
+
+		if refused != (exc != nil) {
+			t.Errorf("depth %d: %v, want refused %v", depth, exc, refused)
+		}
+
+		if exc != nil && !strings.HasPrefix(exc.what().Error(), "loop detected: caller reached portal depth") {
+			t.Errorf("depth %d: %v", depth, exc.what())
+		}
+	}
+
+	// what we spawn carries one more than the caller had
+	found := ""
+
+	for _, env := range childEnv(1) {
+		if strings.HasPrefix(env, "PORTAL_DEPTH=") {
+			found = env
+		}
+	}
+
+	if found != "PORTAL_DEPTH=2" {
+		t.Errorf("childEnv(1) sets %q", found)
+	}
+}
+
+// the process exit code cb would end in, as main reports it
+func exitCode(t *testing.T, cb func()) int {
+	t.Helper()
+
+	code := -1
+
+	exit = func(c int) {
+		code = c
+	}
+
+	defer func() {
+		exit = os.Exit
+	}()
+
+	try(cb).catch(func(exc *Exception) {
+		exc.fatal(exitFailure, "test")
+	})
+
+	return code
+}
+
+func TestExitCodes(t *testing.T) {
+	if code := exitCode(t, func() {}); code != -1 {
+		t.Errorf("no failure exited %d", code)
+	}
+
+	if code := exitCode(t, func() { fmtException("plain").throw() }); code != exitFailure {
+		t.Errorf("plain failure exited %d, want %d", code, exitFailure)
+	}
+
+	if code := exitCode(t, func() { cli([]string{"--bogus"}) }); code != exitConfig {
+		t.Errorf("bad flag exited %d, want %d", code, exitConfig)
+	}
+
+	if code := exitCode(t, func() { cli([]string{"--list-settings", "--format=yaml"}) }); code != exitConfig {
+		t.Errorf("bad format exited %d, want %d", code, exitConfig)
+	}
+
+	t.Setenv("PORTAL_ON_NAME_TAKEN", "queue")
+
+	if code := exitCode(t, func() { nameFlags(false) }); code != exitConfig {
+		t.Errorf("bad PORTAL_ON_NAME_TAKEN exited %d, want %d", code, exitConfig)
+	}
+
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", "unix:path="+filepath.Join(t.TempDir(), "nobus"))
+
+	if code := exitCode(t, func() { sessionBus().Close() }); code != exitNoBus {
+		t.Errorf("no session bus exited %d, want %d", code, exitNoBus)
+	}
+}
+
+func TestExitNameTaken(t *testing.T) {
+	addr := testBusAddr(t)
+
+	t.Setenv("PORTAL_ON_NAME_TAKEN", "fail")
+
+	// the owner does not allow replacement, so --replace can not take it either
+	owner := testConn(t, addr)
+	ownName(t, owner, "org.freedesktop.portal.Desktop")
+
+	for _, replace := range []bool{false, true} {
+		conn := testConn(t, addr)
+
+		if code := exitCode(t, func() { bind(conn, "org.freedesktop.portal.Desktop", nameFlags(replace)) }); code != exitNameTaken {
+			t.Errorf("name taken, replace %v: exited %d, want %d", replace, code, exitNameTaken)
+		}
+	}
+}
+
+// call a request method and wait for its Response
+func (b *testBus) request(t *testing.T, method string, args ...interface{}) (uint32, map[string]dbus.Variant) {
+	t.Helper()
+
+	var handle dbus.ObjectPath
+
+	if err := b.obj.Call(method, 0, args...).Store(&handle); err != nil {
+		t.Fatalf("%s: %v", method, err)
+	}
+
+	code, results, ok := b.response(t, handle, 10*time.Second)
+
+	if !ok {
+		t.Fatalf("%s: no response on %s", method, handle)
+	}
+
+	return code, results
+}
+
+func TestDisabledMethods(t *testing.T) {
+	t.Setenv("PORTAL_DISABLED_METHODS", " OpenURI.OpenURI ,,Screenshot.Screenshot")
+
+	if err := disabled("OpenURI.OpenURI"); err == nil || err.Name != "org.freedesktop.DBus.Error.NotSupported" {
+		t.Errorf("disabled OpenURI.OpenURI: %v", err)
+	}
+
+	if err := disabled("OpenURI.OpenFile"); err != nil {
+		t.Errorf("OpenURI.OpenFile is not disabled: %v", err)
+	}
+
+	// disabled methods stay exported and fail the call, nothing is left in flight
+	b := startPortal(t, func(uri string, opts openOptions) openResult {
+		return openResult{}
+	})
+
+	if _, err := b.openURI("off", "https://example.org/"); dbusErrorName(err) != "org.freedesktop.DBus.Error.NotSupported" {
+		t.Errorf("OpenURI call: %v, want NotSupported", err)
+	}
+
+	if n := b.live(); n != 0 {
+		t.Errorf("%d requests left by a disabled method", n)
+	}
+
+	t.Setenv("PORTAL_DISABLED_METHODS", "")
+
+	if _, err := b.openURI("on", "https://example.org/"); err != nil {
+		t.Errorf("OpenURI after enabling it again: %v", err)
+	}
+}
+
+// log output of the test, safe for the portal's goroutines to write to
+type logBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.buf.String()
+}
+
+func captureLog(t *testing.T) *logBuffer {
+	t.Helper()
+
+	res := &logBuffer{}
+	old := log.Writer()
+
+	log.SetOutput(res)
+	t.Cleanup(func() {
+		log.SetOutput(old)
+	})
+
+	return res
+}
+
+func TestRequestLogger(t *testing.T) {
+	logs := captureLog(t)
+
+	b := startPortal(t, func(uri string, opts openOptions) openResult {
+		opts.log().Println("opening", uri)
+
+		return openResult{}
+	})
+
+	if code, _ := b.request(t, "org.freedesktop.portal.OpenURI.OpenURI", "", "https://example.org/", kv{"handle_token": dbus.MakeVariant("logged")}); code != 0 {
+		t.Fatalf("code %d", code)
+	}
+
+	prefix := "method=OpenURI sender=" + b.client.Names()[0] + " token=logged id="
+
+	var lines []string
+
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, prefix) {
+			lines = append(lines, line)
+		}
+	}
+
+	// the entry and what the opener logged through the request's logger
+	if len(lines) < 2 || !strings.HasSuffix(lines[0], "enter  https://example.org/ map[handle_token:\"logged\"]") {
+		t.Fatalf("request lines %q in\n%s", lines, logs)
+	}
+
+	found := false
+
+	for _, line := range lines {
+		found = found || strings.HasSuffix(line, "opening https://example.org/")
+	}
+
+	if !found {
+		t.Errorf("opener line not prefixed, got %q", lines)
+	}
+}
+
+func TestDescribeOwner(t *testing.T) {
+	addr := testBusAddr(t)
+
+	owner := testConn(t, addr)
+	ownName(t, owner, "org.freedesktop.portal.Desktop")
+
+	conn := testConn(t, addr)
+
+	comm, _ := os.ReadFile("/proc/self/comm")
+	want := fmt.Sprintf("held by %s (PID %d, %s)", owner.Names()[0], os.Getpid(), strings.TrimSpace(string(comm)))
+
+	if got := describeOwner(conn, "org.freedesktop.portal.Desktop"); got != want {
+		t.Errorf("describeOwner = %q, want %q", got, want)
+	}
+
+	if got := describeOwner(conn, "org.example.Nobody"); !strings.HasPrefix(got, "owner unknown: ") {
+		t.Errorf("unowned name: %q", got)
+	}
+
+	exc := try(func() {
+		bind(conn, "org.freedesktop.portal.Desktop", dbus.NameFlagDoNotQueue)
+	})
+
+	if exc == nil || !strings.HasSuffix(exc.what().Error(), "already taken, "+want) {
+		t.Errorf("bind: %v, want it to name the owner", exc)
+	}
+}
+
+func TestResolveURI(t *testing.T) {
+	t.Setenv("HOME", "/home/user")
+	t.Setenv("PORTAL_URI_BASE", "")
+	os.Unsetenv("PORTAL_URI_BASE")
+
+	cases := []struct {
+		uri  string
+		want string
+	}{
+		{"/tmp/a b.txt", "file:///tmp/a%20b.txt"},
+		{"notes.txt", "file:///home/user/notes.txt"},
+		{"file:notes.txt", "file:///home/user/notes.txt"},
+		{"file:docs/a%20b.txt", "file:///home/user/docs/a%20b.txt"},
+		{"file:///etc/hosts", "file:///etc/hosts"},
+		{"https://example.org/x", "https://example.org/x"},
+		{"mailto:someone@example.org", "mailto:someone@example.org"},
+		{"file:bad%zz", "file:bad%zz"},
+	}
+
+	for _, c := range cases {
+		if got := resolveURI(c.uri); got != c.want {
+			t.Errorf("resolveURI(%q) = %q, want %q", c.uri, got, c.want)
+		}
+	}
+
+	t.Setenv("PORTAL_URI_BASE", "/srv")
+
+	if got := resolveURI("notes.txt"); got != "file:///srv/notes.txt" {
+		t.Errorf("with URI_BASE: %q", got)
+	}
+}
+
+func TestAutoAnswer(t *testing.T) {
+	b := startPortal(t, nil)
+
+	home := os.Getenv("HOME")
+	pick := filepath.Join(home, "pick.txt")
+	save := filepath.Join(home, "save.txt")
+
+	if err := os.WriteFile(pick, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PORTAL_FILECHOOSER_AUTOANSWER", pick)
+	t.Setenv("PORTAL_FILECHOOSER_SAVE_AUTOANSWER", save)
+	// no zenity to fall back to
+	t.Setenv("PATH", t.TempDir())
+
+	if got := activeDialogBackend(); got != "autoanswer" {
+		t.Errorf("activeDialogBackend = %q", got)
+	}
+
+	cases := []struct {
+		method string
+		want   string
+	}{
+		{"org.freedesktop.portal.FileChooser.OpenFile", pick},
+		{"org.freedesktop.portal.FileChooser.SaveFile", save},
+	}
+
+	for i, c := range cases {
+		options := kv{"handle_token": dbus.MakeVariant(fmt.Sprintf("auto%d", i))}
+		code, results := b.request(t, c.method, "", "title", options)
+
+		if code != 0 {
+			t.Errorf("%s answered %d", c.method, code)
+
+			continue
+		}
+
+		uris, _ := results["uris"].Value().([]string)
+
+		if len(uris) != 1 || uris[0] != fileURI(c.want) {
+			t.Errorf("%s uris = %v, want %s", c.method, uris, fileURI(c.want))
+		}
+	}
+}
+
+func TestCapSelection(t *testing.T) {
+	b := startPortal(t, nil)
+
+	var paths []string
+
+	for i := 0; i < 10; i++ {
+		paths = append(paths, fmt.Sprintf("%q", fmt.Sprintf("/tmp/file%d", i)))
+	}
+
+	plugin := writeScript(t, t.TempDir(), "plugin", fmt.Sprintf(`echo '{"response": 0, "paths": [%s]}'`, strings.Join(paths, ", ")))
+	t.Setenv("PORTAL_FILECHOOSER_PLUGIN", plugin)
+
+	cases := []struct {
+		limit    string
+		overflow string
+		code     uint32
+		uris     int
+	}{
+		{"20", "fail", 0, 10},
+		{"10", "fail", 0, 10},
+		{"3", "fail", 2, 0},
+		{"3", "truncate", 0, 3},
+		{"0", "truncate", 2, 0},
+		{"-1", "truncate", 2, 0},
+		{"lots", "truncate", 2, 0},
+	}
+
+	for i, c := range cases {
+		t.Setenv("PORTAL_FILECHOOSER_MAX_URIS", c.limit)
+		t.Setenv("PORTAL_FILECHOOSER_OVERFLOW", c.overflow)
+
+		options := kv{
+			"handle_token": dbus.MakeVariant(fmt.Sprintf("cap%d", i)),
+			"multiple":     dbus.MakeVariant(true),
+		}
+
+		code, results := b.request(t, "org.freedesktop.portal.FileChooser.OpenFile", "", "title", options)
+		uris, _ := results["uris"].Value().([]string)
+
+		if code != c.code || len(uris) != c.uris {
+			t.Errorf("MAX_URIS=%s OVERFLOW=%s: code %d with %d uris, want %d with %d", c.limit, c.overflow, code, len(uris), c.code, c.uris)
+		}
+	}
+}
+
+func TestExecError(t *testing.T) {
+	dir := t.TempDir()
+	tool := filepath.Join(dir, "zenity")
+
+	// there, but not executable: what a MAC denial looks like to us
+	if err := os.WriteFile(tool, []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := exec.Command(tool).Run()
+
+	if !errors.Is(err, syscall.EACCES) {
+		t.Fatalf("running a non executable file: %v, want EACCES", err)
+	}
+
+	if got := execError("zenity", err); !strings.Contains(got, "exec denied") || !strings.Contains(got, "AppArmor/SELinux") {
+		t.Errorf("EACCES: %q, want the policy hint", got)
+	}
+
+	if got := execError("zenity", &os.PathError{Op: "fork/exec", Path: tool, Err: syscall.EPERM}); !strings.Contains(got, "exec denied") {
+		t.Errorf("EPERM: %q, want the policy hint", got)
+	}
+
+	t.Setenv("PATH", dir)
+
+	err = exec.Command("no-such-tool").Run()
+
+	if got := execError("no-such-tool", err); !strings.HasPrefix(got, "no-such-tool not found") {
+		t.Errorf("missing tool: %q", got)
+	}
+
+	if got := execError("zenity", errors.New("boom")); got != "zenity: boom" {
+		t.Errorf("other failure: %q", got)
+	}
+}
+
+func TestCapabilitySettings(t *testing.T) {
+	t.Setenv("PORTAL_DISABLED_METHODS", "FileChooser.SaveFile")
+	t.Setenv("PORTAL_FILECHOOSER_AUTOANSWER", "/tmp/x")
+	t.Setenv("PORTAL_OPEN_COMMAND", "true {uri}")
+	t.Setenv("XDG_SESSION_TYPE", "x11")
+
+	// probed afresh under the environment above
+	caps.Store(nil)
+
+	t.Cleanup(func() {
+		caps.Store(nil)
+	})
+
+	b := startPortal(t, nil)
+
+	var all map[string]map[string]dbus.Variant
+
+	if err := b.obj.Call("org.freedesktop.portal.Settings.ReadAll", 0, []string{extNamespace}).Store(&all); err != nil {
+		t.Fatal(err)
+	}
+
+	got := all[extNamespace]
+
+	ifaces, _ := got["interfaces"].Value().([]string)
+	listed := " " + strings.Join(ifaces, " ") + " "
+
+	for _, iface := range []string{"org.freedesktop.portal.Settings", "org.freedesktop.portal.FileChooser"} {
+		if !strings.Contains(listed, " "+iface+" ") {
+			t.Errorf("interfaces = %v, want %s among them", ifaces, iface)
+		}
+	}
+
+	if v, _ := got["disabled-methods"].Value().([]string); len(v) != 1 || v[0] != "FileChooser.SaveFile" {
+		t.Errorf("disabled-methods = %v", got["disabled-methods"])
+	}
+
+	want := map[string]string{
+		"open-backend":        "template",
+		"filechooser-backend": "autoanswer",
+		"screenshot-backend":  "maim",
+	}
+
+	for key, val := range want {
+		if v, _ := got[key].Value().(string); v != val {
+			t.Errorf("%s = %v, want %q", key, got[key], val)
+		}
+	}
+}
+
+func TestSettingsCoalesce(t *testing.T) {
+	b := startPortal(t, nil)
+
+	conn := testConn(t, b.addr)
+	got := make(chan *dbus.Signal, 16)
+
+	if err := conn.AddMatchSignal(dbus.WithMatchInterface("org.freedesktop.portal.Settings"), dbus.WithMatchMember("SettingChanged")); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Signal(got)
+
+	st := &Settings{portal: b.portal}
+	first, second := &settings[0], &settings[1]
+
+	t.Setenv("PORTAL_SETTINGS_COALESCE", "200ms")
+
+	start := time.Now()
+
+	st.changed(first)
+	st.changed(second)
+	st.changed(first)
+
+	keys := map[string]int{}
+
+	for i := 0; i < 2; i++ {
+		sig := nextSignal(got, 5*time.Second)
+
+		if sig == nil {
+			t.Fatalf("%d of 2 SettingChanged arrived", i)
+		}
+
+		if i == 0 && time.Since(start) < 200*time.Millisecond {
+			t.Errorf("SettingChanged went out after %v, before the window closed", time.Since(start))
+		}
+
+		keys[fmt.Sprintf("%v.%v", sig.Body[0], sig.Body[1])]++
+	}
+
+	if sig := nextSignal(got, 400*time.Millisecond); sig != nil {
+		t.Errorf("extra SettingChanged %v", sig.Body)
+	}
+
+	for _, s := range []*setting{first, second} {
+		if n := keys[s.namespace+"."+s.key]; n != 1 {
+			t.Errorf("%s.%s changed %d times, want once", s.namespace, s.key, n)
+		}
+	}
+
+	// no window, every change goes out as it comes
+	t.Setenv("PORTAL_SETTINGS_COALESCE", "0s")
+
+	st.changed(first)
+	st.changed(first)
+
+	for i := 0; i < 2; i++ {
+		if sig := nextSignal(got, 5*time.Second); sig == nil {
+			t.Fatalf("%d of 2 uncoalesced SettingChanged arrived", i)
+		}
+	}
+}
+
+func TestValidToken(t *testing.T) {
+	for token, want := range map[string]bool{
+		"portal1":    true,
+		"Abc_09":     true,
+		"":           false,
+		"a.b":        false,
+		"a/b":        false,
+		"a-b":        false,
+		"ümlaut":     false,
+		"with space": false,
+	} {
+		if got := validToken(token); got != want {
+			t.Errorf("validToken(%q) = %v, want %v", token, got, want)
+		}
+	}
+}
+
+func TestBadTokenRejected(t *testing.T) {
+	b := startPortal(t, nil)
+
+	for _, token := range []string{"a.b", "a-b", "with space"} {
+		if _, err := b.openURI(token, "https://example.org"); dbusErrorName(err) != "org.freedesktop.portal.Error.InvalidArgument" {
+			t.Errorf("token %q: %v, want InvalidArgument", token, err)
+		}
+	}
+
+	if n := b.live(); n != 0 {
+		t.Errorf("%d requests left after bad tokens", n)
+	}
+}
+
+func TestRequestLifecycle(t *testing.T) {
+	opened := make(chan string, 1)
+
+	b := startPortal(t, func(uri string, opts openOptions) openResult {
+		opened <- uri
+
+		return openResult{handler: "test", backend: "test"}
+	})
+
+	handle, err := b.openURI("t1", "https://example.org/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := requestKey(b.client.Names()[0], "t1"); handle != want {
+		t.Errorf("handle %s, want %s", handle, want)
+	}
+
+	code, results, ok := b.response(t, handle, 5*time.Second)
+
+	if !ok {
+		t.Fatal("no response")
+	}
+
+	if handler, _ := results["handler"].Value().(string); code != 0 || handler != "test" {
+		t.Errorf("response %d %v, want 0 with handler test", code, results)
+	}
+
+	if uri := <-opened; uri != "https://example.org/" {
+		t.Errorf("opened %s", uri)
+	}
+
+	if n := b.live(); n != 0 {
+		t.Errorf("%d requests left after the response", n)
+	}
+
+	// unexported with the response, a Close now finds nothing there
+	call := b.client.Object("org.freedesktop.portal.Desktop", handle).Call("org.freedesktop.portal.Request.Close", 0)
+
+	if call.Err == nil {
+		t.Error("Close on a finished request succeeded")
+	}
+
+	// the token is free again
+	if _, err := b.openURI("t1", "https://example.org/"); err != nil {
+		t.Errorf("reusing a finished token: %v", err)
+	}
+}
+
+func TestCloseAccess(t *testing.T) {
+	opener, opened, release := blockingOpener()
+	defer close(release)
+
+	b := startPortal(t, opener)
+
+	handle, err := b.openURI("closeme", "https://example.org/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-opened
+
+	other, err := dbus.Connect(b.addr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer other.Close()
+
+	call := other.Object("org.freedesktop.portal.Desktop", handle).Call("org.freedesktop.portal.Request.Close", 0)
+
+	if dbusErrorName(call.Err) != "org.freedesktop.DBus.Error.AccessDenied" {
+		t.Errorf("Close by another client: %v, want AccessDenied", call.Err)
+	}
+
+	if n := b.live(); n != 1 {
+		t.Errorf("%d requests after a denied Close, want 1", n)
+	}
+
+	call = b.client.Object("org.freedesktop.portal.Desktop", handle).Call("org.freedesktop.portal.Request.Close", 0)
+
+	if call.Err != nil {
+		t.Errorf("Close by the caller: %v", call.Err)
+	}
+
+	if n := b.live(); n != 0 {
+		t.Errorf("%d requests after Close, want 0", n)
+	}
+}
+
+func TestValidSettingName(t *testing.T) {
+	cases := []struct {
+		namespace string
+		key       string
+		ok        bool
+	}{
+		{"org.freedesktop.appearance", "color-scheme", true},
+		{"org.gnome.desktop.interface", "gtk_theme", true},
+		{"", "color-scheme", false},
+		{"org..appearance", "color-scheme", false},
+		{"org.freedesktop.appearance.", "color-scheme", false},
+		{"org/freedesktop", "color-scheme", false},
+		{"org.freedesktop.appearance", "", false},
+		{"org.freedesktop.appearance", "color.scheme", false},
+		{"org.freedesktop.appearance", "color scheme", false},
+	}
+
+	for _, c := range cases {
+		err := validSettingName(c.namespace, c.key)
+
+		if c.ok && err != nil {
+			t.Errorf("%q %q: %v", c.namespace, c.key, err)
+		}
+
+		if !c.ok && (err == nil || err.Name != "org.freedesktop.portal.Error.InvalidArgument") {
+			t.Errorf("%q %q: %v, want InvalidArgument", c.namespace, c.key, err)
+		}
+	}
+
+	b := startPortal(t, nil)
+
+	call := b.obj.Call("org.freedesktop.portal.Settings.Read", 0, "org..appearance", "color-scheme")
+
+	if dbusErrorName(call.Err) != "org.freedesktop.portal.Error.InvalidArgument" {
+		t.Errorf("Read of a malformed namespace: %v, want InvalidArgument", call.Err)
+	}
+
+	call = b.obj.Call("org.freedesktop.portal.Settings.Read", 0, "org.example.none", "key")
+
+	if call.Err == nil || dbusErrorName(call.Err) == "org.freedesktop.portal.Error.InvalidArgument" {
+		t.Errorf("Read of an unknown setting: %v, want not found", call.Err)
+	}
+}
+
+// a zenity on PATH that reports version 4.0.1 and runs body for dialogs
+func fakeZenity(t *testing.T, body string) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	writeScript(t, dir, "zenity", `for a; do
+	case "$a" in
+	--version) echo 4.0.1; exit 0;;
+	--separator=*) sep="${a#--separator=}";;
+	esac
+done
+`+body)
+
+	t.Setenv("PATH", dir+":/bin:/usr/bin")
+
+	caps.Store(nil)
+
+	t.Cleanup(func() {
+		caps.Store(nil)
+	})
+}
+
+func TestSelectionNewline(t *testing.T) {
+	fakeZenity(t, `printf '/tmp/a\nb%s/tmp/c\n' "$sep"`)
+
+	b := startPortal(t, nil)
+
+	options := kv{
+		"handle_token": dbus.MakeVariant("newline"),
+		"multiple":     dbus.MakeVariant(true),
+	}
+
+	code, results := b.request(t, "org.freedesktop.portal.FileChooser.OpenFile", "", "title", options)
+	uris, _ := results["uris"].Value().([]string)
+
+	want := []string{fileURI("/tmp/a\nb"), fileURI("/tmp/c")}
+
+	if code != 0 || strings.Join(uris, " ") != strings.Join(want, " ") {
+		t.Errorf("answered %d with %q, want 0 with %q", code, uris, want)
+	}
+
+	if sep := selectionSeparator(); sep == selectionSeparator() || strings.ContainsAny(sep, "\n/\x00") {
+		t.Errorf("separator %q is not random or may be part of a path", sep)
+	}
+}
+
+func TestHelperCommand(t *testing.T) {
+	cases := []struct {
+		nice  string
+		scope string
+		want  string
+	}{
+		{"", "", "zenity --info"},
+		{"10", "", "nice -n 10 zenity --info"},
+		{"high", "", "zenity --info"},
+		{"", "1", "systemd-run --user --scope --quiet --collect -- zenity --info"},
+		{"5", "1", "systemd-run --user --scope --quiet --collect -- nice -n 5 zenity --info"},
+	}
+
+	for _, c := range cases {
+		t.Setenv("PORTAL_HELPER_NICE", c.nice)
+		t.Setenv("PORTAL_HELPER_SCOPE", c.scope)
+
+		cmd := helperCommand(context.Background(), "zenity", "--info")
+
+		if got := strings.Join(cmd.Args, " "); got != c.want {
+			t.Errorf("NICE=%q SCOPE=%q: %q, want %q", c.nice, c.scope, got, c.want)
+		}
+	}
+}
+
+// the GTK_THEME a dialog starts with, the last one wins
+func dialogTheme(env []string) string {
+	res := ""
+
+	for _, e := range env {
+		if val, ok := strings.CutPrefix(e, "GTK_THEME="); ok {
+			res = val
+		}
+	}
+
+	return res
+}
+
+func TestSaveFileFilename(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "args")
+
+	fakeZenity(t, `printf '%s\n' "$@" > `+out+`; echo "$HOME/saved"`)
+
+	b := startPortal(t, nil)
+
+	home := os.Getenv("HOME")
+
+	for _, c := range []struct {
+		options kv
+		want    string
+	}{
+		// no name, zenity opens in home instead of prefilling its base name
+		{kv{}, home + "/"},
+		{kv{"current_name": dbus.MakeVariant("")}, home + "/"},
+		{kv{"current_name": dbus.MakeVariant("a.txt")}, filepath.Join(home, "a.txt")},
+		{kv{"current_folder": dbus.MakeVariant([]byte("/tmp/\x00"))}, "/tmp/"},
+	} {
+		c.options["handle_token"] = dbus.MakeVariant("save")
+
+		if code, _ := b.request(t, "org.freedesktop.portal.FileChooser.SaveFile", "", "title", c.options); code != 0 {
+			t.Fatalf("SaveFile %v answered %d", c.options, code)
+		}
+
+		data, err := os.ReadFile(out)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+
+		for _, arg := range strings.Split(string(data), "\n") {
+			if name, ok := strings.CutPrefix(arg, "--filename="); ok {
+				got = append(got, name)
+			}
+		}
+
+		if len(got) != 1 || got[0] != c.want {
+			t.Errorf("SaveFile %v: zenity --filename=%q, want %q", c.options, got, c.want)
+		}
+	}
+}
+
+func TestDialogEnvTheme(t *testing.T) {
+	dir := t.TempDir()
+
+	// what the user set in gnome, or no gsettings at all
+	writeScript(t, dir, "gsettings", `[ "$3" = color-scheme ] && [ -n "$FAKE_SCHEME" ] || exit 1
+echo "'$FAKE_SCHEME'"`)
+
+	t.Setenv("PATH", dir+":/bin:/usr/bin")
+	t.Setenv("PORTAL_GSETTINGS_TTL", "0s")
+	t.Setenv("GTK_THEME", "Custom")
+	t.Setenv("PORTAL_DIALOG_NO_AT_BRIDGE", "")
+
+	cases := []struct {
+		mode   string
+		scheme string
+		want   string
+	}{
+		// no preference of the user to follow, inherit GTK_THEME as is
+		{"follow", "", ""},
+		{"follow", "default", ""},
+		{"follow", "prefer-dark", "Custom:dark"},
+		{"follow", "prefer-light", "Custom"},
+		{"dark", "prefer-light", "Custom:dark"},
+		{"light", "prefer-dark", "Custom"},
+	}
+
+	for _, c := range cases {
+		t.Setenv("PORTAL_DIALOG_THEME", c.mode)
+		t.Setenv("FAKE_SCHEME", c.scheme)
+
+		if got := dialogTheme(dialogEnv()); got != c.want {
+			t.Errorf("DIALOG_THEME=%s color-scheme=%q: GTK_THEME=%q, want %q", c.mode, c.scheme, got, c.want)
+		}
+	}
+
+	t.Setenv("FAKE_SCHEME", "")
+	t.Setenv("PORTAL_DIALOG_THEME", "sepia")
+
+	if env := dialogEnv(); env != nil {
+		t.Errorf("bad DIALOG_THEME changed the environment: %v", env)
+	}
+
+	// no theme name anywhere, none is made up
+	t.Setenv("GTK_THEME", "")
+	t.Setenv("FAKE_SCHEME", "prefer-dark")
+
+	for _, mode := range []string{"follow", "dark", "light"} {
+		t.Setenv("PORTAL_DIALOG_THEME", mode)
+
+		if env := dialogEnv(); env != nil {
+			t.Errorf("DIALOG_THEME=%s without a theme name changed the environment: %v", mode, dialogTheme(env))
+		}
+	}
+}
+
+func TestRequestKey(t *testing.T) {
+	for _, c := range []struct {
+		sender string
+		token  string
+		want   dbus.ObjectPath
+	}{
+		{":1.42", "t1", "/org/freedesktop/portal/desktop/request/1_42/t1"},
+		{":1.7", "portal_3", "/org/freedesktop/portal/desktop/request/1_7/portal_3"},
+		{"org.example.Name", "x", "/org/freedesktop/portal/desktop/request/org_example_Name/x"},
+	} {
+		if got := requestKey(c.sender, c.token); got != c.want {
+			t.Errorf("requestKey(%q, %q) = %s, want %s", c.sender, c.token, got, c.want)
+		}
+
+		if !c.want.IsValid() {
+			t.Errorf("%s is not a valid object path", c.want)
+		}
+	}
+}
+
+func TestRequestTokens(t *testing.T) {
+	opener, opened, release := blockingOpener()
+
+	b := startPortal(t, opener)
+
+	handle, err := b.openURI("busy", "https://example.org/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-opened
+
+	if _, err := b.openURI("busy", "https://example.org/"); dbusErrorName(err) != "org.freedesktop.portal.Error.InvalidArgument" {
+		t.Errorf("token in flight: %v, want InvalidArgument", err)
+	}
+
+	close(release)
+
+	if code, _, ok := b.response(t, handle, 5*time.Second); !ok || code != 0 {
+		t.Errorf("first request answered %d, %v", code, ok)
+	}
+}
+
+func TestExitResponse(t *testing.T) {
+	for _, c := range []struct {
+		script string
+		code   uint32
+		reason string
+	}{
+		{"exit 1", 1, "tool cancelled"},
+		{"exit 3", 2, "tool failed with exit code 3"},
+		{"exit 126", 2, "tool exited 126, a command it runs is not executable"},
+		{"exit 127", 2, "tool exited 127, a command it runs was not found"},
+		{"kill -9 $$", 2, "tool killed by signal 9"},
+	} {
+		code, reason := exitResponse("tool", exec.Command("sh", "-c", c.script).Run())
+
+		if code != c.code || reason != c.reason {
+			t.Errorf("%s: got %d %q, want %d %q", c.script, code, reason, c.code, c.reason)
+		}
+	}
+
+	code, reason := exitResponse("tool", exec.Command("/nonexistent/tool").Run())
+
+	if code != 2 || !strings.HasPrefix(reason, "tool not found") {
+		t.Errorf("missing binary: got %d %q", code, reason)
+	}
+}
+
+func TestReprobeToolAppears(t *testing.T) {
+	dir := t.TempDir()
+
+	// zenity is not there yet, the bus still has to start
+	daemon, _ := exec.LookPath("dbus-daemon")
+
+	t.Setenv("PATH", dir+":"+filepath.Dir(daemon))
+	t.Setenv("PORTAL_ZENITY_CHECK", "1")
+	t.Setenv("PORTAL_REPROBE_INTERVAL", "100ms")
+	t.Setenv("PORTAL_SETTINGS_COALESCE", "0s")
+
+	caps.Store(nil)
+
+	t.Cleanup(func() {
+		caps.Store(nil)
+	})
+
+	b := startPortal(t, nil)
+
+	conn := testConn(t, b.addr)
+	got := make(chan *dbus.Signal, 16)
+
+	if err := conn.AddMatchSignal(dbus.WithMatchObjectPath(desktopPath)); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Signal(got)
+
+	const iface = "org.freedesktop.portal.FileChooser"
+
+	if _, err := b.obj.GetProperty(iface + ".version"); err == nil {
+		t.Fatal("FileChooser served without zenity")
+	}
+
+	writeScript(t, dir, "zenity", "echo 4.0.1")
+
+	var changed, listed bool
+
+	for timeout := time.After(5 * time.Second); !changed || !listed; {
+		select {
+		case sig := <-got:
+			switch {
+			case sig.Name == "org.freedesktop.DBus.Properties.PropertiesChanged" && sig.Body[0] == iface:
+				v, _ := sig.Body[1].(map[string]dbus.Variant)["version"].Value().(uint32)
+
+				if v != fileChooserVersion() {
+					t.Errorf("PropertiesChanged version %d, want %d", v, fileChooserVersion())
+				}
+
+				changed = true
+			case sig.Name == "org.freedesktop.portal.Settings.SettingChanged" && sig.Body[1] == "interfaces":
+				ifaces, _ := sig.Body[2].(dbus.Variant).Value().([]string)
+
+				if !strings.Contains(" "+strings.Join(ifaces, " ")+" ", " "+iface+" ") {
+					t.Errorf("interfaces changed to %v, without FileChooser", ifaces)
+				}
+
+				listed = true
+			}
+		case <-timeout:
+			t.Fatalf("after zenity appeared: PropertiesChanged %v, interfaces changed %v", changed, listed)
+		}
+	}
+
+	if v, err := b.obj.GetProperty(iface + ".version"); err != nil || v.Value() != fileChooserVersion() {
+		t.Errorf("FileChooser version after the reprobe: %v, %v", v, err)
+	}
+
+	if v := capability("filechooser-version"); v != "4.0.1" {
+		t.Errorf("filechooser-version = %v, want 4.0.1", v)
+	}
+}
+
+func TestFileMetadata(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a b.txt")
+
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Unix(1700000000, 0)
+
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	res := fileMetadata(quiet, []string{path, filepath.Join(dir, "gone")})
+
+	if len(res) != 1 {
+		t.Fatalf("metadata for %d files, want the one that exists: %v", len(res), res)
+	}
+
+	meta := res[fileURI(path)]
+
+	if size, _ := meta["size"].Value().(uint64); size != 5 {
+		t.Errorf("size %v, want 5", meta["size"])
+	}
+
+	if at, _ := meta["mtime"].Value().(uint64); at != uint64(mtime.Unix()) {
+		t.Errorf("mtime %v, want %d", meta["mtime"], mtime.Unix())
+	}
+}
+
+func TestCheckOptionsStrict(t *testing.T) {
+	t.Setenv("PORTAL_STRICT", "")
+
+	typo := kv{"handle_token": dbus.MakeVariant("t"), "mutliple": dbus.MakeVariant(true)}
+
+	if err := checkOptions("FileChooser.OpenFile", typo); err != nil {
+		t.Errorf("lenient by default: %v", err)
+	}
+
+	typo["strict"] = dbus.MakeVariant(true)
+
+	if err := checkOptions("FileChooser.OpenFile", typo); err == nil || err.Name != "org.freedesktop.portal.Error.InvalidArgument" {
+		t.Errorf("strict option with a typo: %v, want InvalidArgument", err)
+	}
+
+	good := kv{"handle_token": dbus.MakeVariant("t"), "multiple": dbus.MakeVariant(true), "strict": dbus.MakeVariant(true)}
+
+	if err := checkOptions("FileChooser.OpenFile", good); err != nil {
+		t.Errorf("strict with known options: %v", err)
+	}
+
+	t.Setenv("PORTAL_STRICT", "1")
+
+	delete(typo, "strict")
+
+	if err := checkOptions("FileChooser.OpenFile", typo); err == nil {
+		t.Error("PORTAL_STRICT=1 let a typo through")
+	}
+
+	// refused before a request exists
+	b := startPortal(t, nil)
+
+	var handle dbus.ObjectPath
+
+	err := b.obj.Call("org.freedesktop.portal.FileChooser.OpenFile", 0, "", "title", typo).Store(&handle)
+
+	if dbusErrorName(err) != "org.freedesktop.portal.Error.InvalidArgument" {
+		t.Errorf("strict OpenFile call: %v, want InvalidArgument", err)
+	}
+
+	if n := b.live(); n != 0 {
+		t.Errorf("%d requests left by a refused call", n)
+	}
+}
+
+func TestExpandTilde(t *testing.T) {
+	t.Setenv("HOME", "/home/u")
+
+	for in, want := range map[string]string{
+		"~":           "/home/u",
+		"~/Documents": "/home/u/Documents",
+		"~bob/x":      "~bob/x",
+		"/tmp/~":      "/tmp/~",
+		"a/~/b":       "a/~/b",
+		"":            "",
+	} {
+		if got := expandTilde(in); got != want {
+			t.Errorf("expandTilde(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestHomeDirUnset(t *testing.T) {
+	u, err := user.Current()
+
+	if err != nil || u.HomeDir == "" {
+		t.Skip("no passwd entry to fall back to:", err)
+	}
+
+	t.Setenv("HOME", "/home/from-env")
+
+	if home, err := homeDir(); err != nil || home != "/home/from-env" {
+		t.Errorf("with $HOME: %q, %v", home, err)
+	}
+
+	t.Setenv("HOME", "")
+	os.Unsetenv("HOME")
+	t.Setenv("XDG_CONFIG_HOME", "")
+
+	if home, err := homeDir(); err != nil || home != u.HomeDir {
+		t.Errorf("without $HOME: %q, %v, want %s from passwd", home, err, u.HomeDir)
+	}
+
+	if dir := configHome(); dir != filepath.Join(u.HomeDir, ".config") {
+		t.Errorf("configHome without $HOME = %q", dir)
+	}
+}
+
+func TestReducedMotion(t *testing.T) {
+	dir := t.TempDir()
+
+	// what the user set in gnome, or no such key
+	writeScript(t, dir, "gsettings", `[ -n "$FAKE_ANIMATIONS" ] || exit 1
+echo "$FAKE_ANIMATIONS"`)
+
+	t.Setenv("PATH", dir+":/bin:/usr/bin")
+	t.Setenv("PORTAL_GSETTINGS_TTL", "0s")
+
+	cases := []struct {
+		override   string
+		animations string
+		want       uint32
+	}{
+		{"", "true", 0},
+		{"", "false", 1},
+		{"", "", 0},
+		{"1", "true", 1},
+		{"0", "false", 0},
+		{"maybe", "false", 1},
+	}
+
+	for _, c := range cases {
+		t.Setenv("PORTAL_REDUCED_MOTION", c.override)
+		t.Setenv("FAKE_ANIMATIONS", c.animations)
+
+		if got := reducedMotion(); got != c.want {
+			t.Errorf("REDUCED_MOTION=%q enable-animations=%q: %d, want %d", c.override, c.animations, got, c.want)
+		}
+	}
+
+	t.Setenv("PORTAL_REDUCED_MOTION", "")
+	t.Setenv("FAKE_ANIMATIONS", "false")
+
+	b := startPortal(t, nil)
+
+	var v dbus.Variant
+
+	if err := b.obj.Call("org.freedesktop.portal.Settings.ReadOne", 0, "org.freedesktop.appearance", "reduced-motion").Store(&v); err != nil || v.Value() != uint32(1) {
+		t.Errorf("ReadOne reduced-motion = %v, %v, want 1", v, err)
+	}
+}
+
+func TestFileChooserVersion(t *testing.T) {
+	version := fileChooserVersion()
+
+	if version != 4 {
+		t.Errorf("fileChooserVersion() = %d, want 4", version)
+	}
+
+	// never announce a level with a feature nobody handles
+	for v := 1; v <= int(version); v++ {
+		for _, f := range fileChooserLevels[v] {
+			if !fileChooserHandles(f) {
+				t.Errorf("version %d announced but %s is not handled", v, f)
+			}
+		}
+	}
+
+	for _, f := range []string{"Bogus", "OpenFile.bogus", "SaveFiles.multiple"} {
+		if fileChooserHandles(f) {
+			t.Errorf("fileChooserHandles(%q) = true", f)
+		}
+	}
+}
+
+func TestChoicesResult(t *testing.T) {
+	if res := choicesResult(quiet, kv{}); res != nil {
+		t.Errorf("no choices option answered %v", res)
+	}
+
+	if res := choicesResult(quiet, kv{"choices": dbus.MakeVariant("bad")}); res != nil {
+		t.Errorf("bad choices option answered %v", res)
+	}
+
+	options := kv{
+		"choices": dbus.MakeVariant([]fileChoice{
+			{"encrypt", "Encrypt", nil, "true"},
+			{"compress", "Compress", nil, ""},
+			{"encoding", "Encoding", []choiceValue{{"utf8", "UTF-8"}, {"latin1", "Latin-1"}}, "latin1"},
+			{"format", "Format", []choiceValue{{"png", "PNG"}, {"jpg", "JPEG"}}, "webp"},
+		}),
+	}
+
+	var got []string
+
+	for _, c := range choicesResult(quiet, options) {
+		got = append(got, c.ID+"="+c.Label)
+	}
+
+	want := "encrypt=true compress=false encoding=latin1 format=png"
+
+	if strings.Join(got, " ") != want {
+		t.Errorf("choicesResult = %v, want %s", got, want)
+	}
+}
+
+func TestCorrelationID(t *testing.T) {
+	t.Setenv("PORTAL_RESPONSE_ID", "1")
+
+	logs := captureLog(t)
+
+	b := startPortal(t, func(uri string, opts openOptions) openResult {
+		opts.log().Println("opening", uri)
+
+		return openResult{}
+	})
+
+	seen := map[string]bool{}
+
+	for _, token := range []string{"first", "second"} {
+		code, results := b.request(t, "org.freedesktop.portal.OpenURI.OpenURI", "", "https://example.org/", kv{"handle_token": dbus.MakeVariant(token)})
+
+		if code != 0 {
+			t.Fatalf("%s: code %d", token, code)
+		}
+
+		id, _ := results["correlation_id"].Value().(string)
+
+		if id == "" || seen[id] {
+			t.Fatalf("%s: correlation_id %q, want a fresh one", token, id)
+		}
+
+		seen[id] = true
+
+		// every line of the request carries the id it answered with
+		lines := 0
+
+		for _, line := range strings.Split(logs.String(), "\n") {
+			if !strings.Contains(line, " token="+token+" ") {
+				continue
+			}
+
+			lines++
+
+			if !strings.Contains(line, " id="+id+" ") {
+				t.Errorf("%s: line %q, want id %s", token, line, id)
+			}
+		}
+
+		if lines < 2 {
+			t.Errorf("%s: %d request lines in\n%s", token, lines, logs)
+		}
+	}
+}
+
+func TestResolveFilter(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		filter fileFilter
+		empty  string
+		want   string
+	}{
+		{"globs", fileFilter{"Docs", []filterPattern{{0, "*.txt"}, {0, "*.md"}}}, "", "Docs | *.txt *.md"},
+		{"bar in name", fileFilter{"A|B", []filterPattern{{0, "*.a"}}}, "", "A/B | *.a"},
+		{"no name", fileFilter{" ", []filterPattern{{0, "*.a"}, {0, "*.b"}}}, "", "*.a *.b | *.a *.b"},
+		{"unusable", fileFilter{"Odd", []filterPattern{{0, "a|b"}, {2, "*.c"}}}, "", ""},
+		{"empty", fileFilter{"Empty", nil}, "", ""},
+		{"empty as all", fileFilter{"Empty", nil}, "all", "Empty | *"},
+	} {
+		t.Setenv("PORTAL_FILECHOOSER_EMPTY_FILTER", c.empty)
+
+		got, ok := resolveFilter(quiet, c.filter)
+
+		if c.want == "" {
+			if ok {
+				t.Errorf("%s: got %s, want it skipped", c.name, filterArg(got))
+			}
+
+			continue
+		}
+
+		if !ok || filterArg(got) != "--file-filter="+c.want {
+			t.Errorf("%s: got %s, %v, want %s", c.name, filterArg(got), ok, c.want)
+		}
+	}
+}
+
+func TestMethodTimeout(t *testing.T) {
+	for _, c := range []struct {
+		kind    string
+		env     string
+		options kv
+		want    time.Duration
+	}{
+		{"FileChooser", "", kv{}, 10 * time.Minute},
+		{"OpenURI", "", kv{}, 30 * time.Second},
+		{"Screenshot", "", kv{}, 2 * time.Minute},
+		{"FileChooser", "1h", kv{}, time.Hour},
+		{"OpenURI", "bogus", kv{}, 30 * time.Second},
+		{"OpenURI", "-1s", kv{}, 30 * time.Second},
+		// the caller's option wins over both
+		{"OpenURI", "1h", kv{"timeout": dbus.MakeVariant(uint32(5))}, 5 * time.Second},
+		{"OpenURI", "1h", kv{"timeout": dbus.MakeVariant(int32(7))}, 7 * time.Second},
+		{"Screenshot", "", kv{"timeout": dbus.MakeVariant(uint32(0))}, 2 * time.Minute},
+		{"Screenshot", "", kv{"timeout": dbus.MakeVariant(int32(-5))}, 2 * time.Minute},
+		{"Screenshot", "", kv{"timeout": dbus.MakeVariant("5")}, 2 * time.Minute},
+	} {
+		t.Setenv("PORTAL_TIMEOUT_"+strings.ToUpper(c.kind), c.env)
+
+		if c.env == "" {
+			os.Unsetenv("PORTAL_TIMEOUT_" + strings.ToUpper(c.kind))
+		}
+
+		if got := methodTimeout(c.kind, c.options); got != c.want {
+			t.Errorf("methodTimeout(%s) with %q, %v = %v, want %v", c.kind, c.env, c.options, got, c.want)
+		}
+	}
+}
+
+func TestZenityCheck(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Setenv("PATH", dir+":/bin:/usr/bin")
+	t.Setenv("PORTAL_ZENITY_CHECK", "1")
+
+	t.Cleanup(func() {
+		zenityProblem.Store("")
+	})
+
+	for _, c := range []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{"healthy", "echo 4.0.1", ""},
+		{"crashes", "echo 'Gtk-WARNING: cannot open display' >&2; exit 1", "cannot open display"},
+		{"garbage", "echo oops", `printed "oops"`},
+	} {
+		writeScript(t, dir, "zenity", c.script)
+
+		checkZenity()
+
+		got := unhealthy("org.freedesktop.portal.FileChooser")
+
+		if c.want == "" && got != "" || !strings.Contains(got, c.want) {
+			t.Errorf("%s: unhealthy = %q, want %q", c.name, got, c.want)
+		}
+
+		exported := strings.Join(exportedInterfaces(), " ")
+
+		if strings.Contains(exported, "FileChooser") != (c.want == "") {
+			t.Errorf("%s: exported %s", c.name, exported)
+		}
+	}
+
+	// only probed when asked to
+	t.Setenv("PORTAL_ZENITY_CHECK", "")
+
+	checkZenity()
+
+	if got := unhealthy("org.freedesktop.portal.FileChooser"); got != "" {
+		t.Errorf("unchecked zenity unhealthy: %q", got)
+	}
+
+	// a broken zenity leaves FileChooser off the bus
+	t.Setenv("PORTAL_ZENITY_CHECK", "1")
+
+	b := startPortal(t, nil)
+
+	var handle dbus.ObjectPath
+
+	if err := b.obj.Call("org.freedesktop.portal.FileChooser.OpenFile", 0, "", "Open", kv{}).Store(&handle); err == nil {
+		t.Errorf("FileChooser answered %s with a broken zenity", handle)
+	}
+}
+
+func TestDrainFailsLeftovers(t *testing.T) {
+	opener, opened, release := blockingOpener()
+	defer close(release)
+
+	b := startPortal(t, opener)
+
+	t.Setenv("PORTAL_SHUTDOWN_GRACE", "100ms")
+
+	handle, err := b.openURI("slow", "https://example.org/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-opened
+
+	stopped := make(chan struct{})
+
+	go func() {
+		b.stop()
+		close(stopped)
+	}()
+
+	if code, _, ok := b.response(t, handle, 5*time.Second); !ok || code != 2 {
+		t.Errorf("drained request answered %d, %v, want 2", code, ok)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain did not return")
+	}
+
+	if _, err := b.openURI("late", "https://example.org/"); err == nil {
+		t.Error("a request after drain was accepted")
+	}
+}
+
+func TestDrainWaitsForGrace(t *testing.T) {
+	opener, opened, release := blockingOpener()
+
+	b := startPortal(t, opener)
+
+	t.Setenv("PORTAL_SHUTDOWN_GRACE", "5s")
+
+	handle, err := b.openURI("slow", "https://example.org/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-opened
+
+	stopped := make(chan struct{})
+
+	go func() {
+		b.stop()
+		close(stopped)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	if code, _, ok := b.response(t, handle, 5*time.Second); !ok || code != 0 {
+		t.Errorf("request finishing within the grace answered %d, %v, want 0", code, ok)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain did not return")
+	}
+}
+
+func TestRunHook(t *testing.T) {
+	b := startPortal(t, func(uri string, opts openOptions) openResult {
+		return openResult{}
+	})
+
+	dir := t.TempDir()
+	out := filepath.Join(dir, "hook.out")
+
+	t.Setenv("PORTAL_HOOK", writeScript(t, dir, "hook", `echo "$1 $3 $PORTAL_HOOK_METHOD $PORTAL_HOOK_CODE $PORTAL_HOOK_ID" > `+out+`.tmp && mv `+out+`.tmp `+out))
+
+	handle, err := b.openURI("hooked", "https://example.org/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, ok := b.response(t, handle, 5*time.Second); !ok {
+		t.Fatal("no response")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		data, err := os.ReadFile(out)
+
+		if err != nil {
+			time.Sleep(20 * time.Millisecond)
+
+			continue
+		}
+
+		fields := strings.Fields(string(data))
+
+		if len(fields) != 5 || strings.Join(fields[:4], " ") != "OpenURI.OpenURI 0 OpenURI.OpenURI 0" || fields[4] == "" {
+			t.Errorf("hook got %q", data)
+		}
+
+		return
+	}
+
+	t.Fatal("hook did not run")
+}
+
+// a globs2 under a temp XDG_DATA_HOME, reloaded on first use and after the test
+func fakeMimeGlobs(t *testing.T, globs2 string) string {
+	t.Helper()
+
+	dir := isolate(t)
+	mime := filepath.Join(dir, "data", "mime")
+
+	if err := os.MkdirAll(mime, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(mime, "globs2"), []byte(globs2), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reset := func() {
+		globsOnce = sync.Once{}
+		globsByMime = nil
+	}
+
+	reset()
+	t.Cleanup(reset)
+
+	return dir
+}
+
+func TestResolveMimeFilter(t *testing.T) {
+	dir := fakeMimeGlobs(t, strings.Join([]string{
+		"# comment",
+		"50:image/png:*.png",
+		"50:image/jpeg:*.jpg",
+		"50:image/jpeg:*.jpeg",
+		"50:text/plain:*.txt",
+		"50:text/x-odd:with space.odd",
+		"50:text/x-none:__NOGLOBS__",
+	}, "\n"))
+
+	// a type the user's data dir lists hides what the system one says of it
+	shared := filepath.Join(dir, "share", "mime")
+
+	if err := os.MkdirAll(shared, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(shared, "globs2"), []byte("50:text/plain:*.text\n50:text/markdown:*.md\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name   string
+		filter fileFilter
+		want   string
+	}{
+		{"mime", fileFilter{"Text", []filterPattern{{1, "text/plain"}}}, "Text | *.txt"},
+		{"lower dir", fileFilter{"Markdown", []filterPattern{{1, "text/markdown"}}}, "Markdown | *.md"},
+		{"wildcard mime", fileFilter{"Images", []filterPattern{{1, "image/*"}}}, "Images | *.jpeg *.jpg *.png"},
+		{"dedup", fileFilter{"Text", []filterPattern{{0, "*.txt"}, {1, "text/plain"}, {0, "*.md"}}}, "Text | *.txt *.md"},
+		{"unusable", fileFilter{"Odd", []filterPattern{{1, "text/x-odd"}, {1, "text/x-none"}, {1, "text/x-unknown"}}}, ""},
+	} {
+		got, ok := resolveFilter(quiet, c.filter)
+
+		if c.want == "" {
+			if ok {
+				t.Errorf("%s: got %s, want it skipped", c.name, filterArg(got))
+			}
+
+			continue
+		}
+
+		if !ok || filterArg(got) != "--file-filter="+c.want {
+			t.Errorf("%s: got %s, %v, want %s", c.name, filterArg(got), ok, c.want)
+		}
+	}
+}
+
+func TestCapabilitiesRefreshRace(t *testing.T) {
+	t.Setenv("PORTAL_SETTINGS_COALESCE", "0s")
+
+	// every probe of one refresh reports the same generation, a snapshot mixing
+	// two generations is a torn read
+	var gen atomic.Int64
+
+	probes := map[string]func() any{}
+
+	for key := range capabilityProbes {
+		probes[key] = func() any {
+			return fmt.Sprint(gen.Load())
+		}
+	}
+
+	old := capabilityProbes
+	capabilityProbes = probes
+	caps.Store(nil)
+
+	t.Cleanup(func() {
+		capabilityProbes = old
+		caps.Store(nil)
+	})
+
+	b := startPortal(t, nil)
+	st := &Settings{portal: b.portal}
+
+	stop := make(chan struct{})
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				if capability("open-backend") == nil {
+					t.Error("capability read nothing")
+
+					return
+				}
+
+				snap := *caps.Load()
+				seen := map[any]bool{}
+
+				for _, v := range snap {
+					seen[v] = true
+				}
+
+				if len(seen) != 1 {
+					t.Errorf("torn snapshot %v", snap)
+
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		gen.Add(1)
+		st.reprobe()
+	}
+
+	close(stop)
+	wg.Wait()
+
+	if got := capability("open-backend"); got != "200" {
+		t.Errorf("open-backend = %v after 200 refreshes, want 200", got)
+	}
+}
+
+func TestRequestIntrospection(t *testing.T) {
+	opener, opened, release := blockingOpener()
+
+	b := startPortal(t, opener)
+
+	handle, err := b.openURI("looked", "https://example.org/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-opened
+
+	introspect := func() string {
+		var xml string
+
+		b.client.Object("org.freedesktop.portal.Desktop", handle).Call("org.freedesktop.DBus.Introspectable.Introspect", 0).Store(&xml)
+
+		return xml
+	}
+
+	xml := introspect()
+
+	for _, want := range []string{`<interface name="org.freedesktop.portal.Request">`, `<method name="Close">`, `<signal name="Response">`} {
+		if !strings.Contains(xml, want) {
+			t.Errorf("live request introspects without %s:\n%s", want, xml)
+		}
+	}
+
+	close(release)
+
+	if _, _, ok := b.response(t, handle, 5*time.Second); !ok {
+		t.Fatal("no response")
+	}
+
+	if xml := introspect(); strings.Contains(xml, "org.freedesktop.portal.Request") {
+		t.Errorf("finished request still introspects as one:\n%s", xml)
+	}
+}
+
+func TestDialogNoATBridge(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "env")
+
+	fakeZenity(t, `echo "bridge=$NO_AT_BRIDGE" > `+out+`; echo /tmp/a`)
+
+	// not inherited from whoever runs the tests
+	t.Setenv("NO_AT_BRIDGE", "")
+	os.Unsetenv("NO_AT_BRIDGE")
+
+	b := startPortal(t, nil)
+
+	for i, c := range []struct {
+		set  string
+		want string
+	}{
+		{"", "bridge="},
+		{"1", "bridge=1"},
+	} {
+		t.Setenv("PORTAL_DIALOG_NO_AT_BRIDGE", c.set)
+
+		options := kv{"handle_token": dbus.MakeVariant(fmt.Sprintf("bridge%d", i))}
+
+		if code, _ := b.request(t, "org.freedesktop.portal.FileChooser.OpenFile", "", "title", options); code != 0 {
+			t.Fatalf("DIALOG_NO_AT_BRIDGE=%q: code %d", c.set, code)
+		}
+
+		data, err := os.ReadFile(out)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := strings.TrimSpace(string(data)); got != c.want {
+			t.Errorf("DIALOG_NO_AT_BRIDGE=%q: zenity ran with %s, want %s", c.set, got, c.want)
+		}
+	}
+}
+
+func TestQueryURIType(t *testing.T) {
+	fakePath(t, map[string]string{
+		"xdg-mime": `case "$3" in *.txt) echo text/plain;; *) echo application/octet-stream;; esac`,
+	})
+
+	sandboxed := fakeSandbox(t)
+
+	b := startPortal(t, nil)
+
+	dir := t.TempDir()
+	notes := filepath.Join(dir, "notes.txt")
+
+	if err := os.WriteFile(notes, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(uri string) (string, error) {
+		var mime string
+
+		err := b.obj.Call(extNamespace+".OpenURI.QueryURIType", 0, uri).Store(&mime)
+
+		return mime, err
+	}
+
+	for _, c := range []struct {
+		uri  string
+		want string
+		err  string
+	}{
+		{"https://example.org/", "x-scheme-handler/https", ""},
+		{"MailTo:a@example.org", "x-scheme-handler/mailto", ""},
+		{fileURI(notes), "text/plain", ""},
+		{fileURI(filepath.Join(dir, "missing.txt")), "", "org.freedesktop.portal.Error.NotFound"},
+		{"no scheme", "", "org.freedesktop.portal.Error.InvalidArgument"},
+	} {
+		mime, err := query(c.uri)
+
+		if mime != c.want || dbusErrorName(err) != c.err {
+			t.Errorf("QueryURIType(%s) = %q, %v, want %q, %s", c.uri, mime, err, c.want, c.err)
+		}
+	}
+
+	// root reads whatever the mode says
+	if os.Getuid() != 0 {
+		locked := filepath.Join(dir, "locked.txt")
+
+		if err := os.WriteFile(locked, nil, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := query(fileURI(locked)); err == nil || !strings.Contains(err.Error(), "can not read "+locked) {
+			t.Errorf("unreadable file: %v, want a read error", err)
+		}
+	}
+
+	sandboxed.Store(true)
+
+	if _, err := query(fileURI(notes)); dbusErrorName(err) != "org.freedesktop.DBus.Error.AccessDenied" {
+		t.Errorf("sandboxed file query: %v, want AccessDenied", err)
+	}
+
+	if mime, err := query("https://example.org/"); err != nil || mime != "x-scheme-handler/https" {
+		t.Errorf("sandboxed scheme query: %q, %v", mime, err)
+	}
+}
+
+func TestGsettingsCache(t *testing.T) {
+	var lock sync.Mutex
+
+	reads := 0
+
+	c := &gsettingsCache{
+		calls: map[string]*gsettingsCall{},
+		read: func(schema string, key string) (string, bool) {
+			lock.Lock()
+			defer lock.Unlock()
+
+			reads++
+
+			return schema + "." + key, true
+		},
+	}
+
+	count := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+
+		return reads
+	}
+
+	t.Setenv("PORTAL_GSETTINGS_TTL", "1m")
+
+	for i := 0; i < 3; i++ {
+		if val, ok := c.get("org.gnome.desktop.interface", "gtk-theme"); !ok || val != "org.gnome.desktop.interface.gtk-theme" {
+			t.Fatalf("get = %q, %v", val, ok)
+		}
+	}
+
+	c.get("org.gnome.desktop.interface", "color-scheme")
+
+	if n := count(); n != 2 {
+		t.Errorf("%d reads for two keys within the ttl, want 2", n)
+	}
+
+	c.invalidate()
+	c.get("org.gnome.desktop.interface", "gtk-theme")
+
+	if n := count(); n != 3 {
+		t.Errorf("%d reads after invalidate, want 3", n)
+	}
+
+	t.Setenv("PORTAL_GSETTINGS_TTL", "0")
+
+	c.get("org.gnome.desktop.interface", "gtk-theme")
+	c.get("org.gnome.desktop.interface", "gtk-theme")
+
+	if n := count(); n != 5 {
+		t.Errorf("%d reads with the cache off, want 5", n)
+	}
+}
+
+func TestGsettingsCacheJoinsInFlight(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 8)
+
+	var lock sync.Mutex
+
+	reads := 0
+
+	c := &gsettingsCache{
+		calls: map[string]*gsettingsCall{},
+		read: func(schema string, key string) (string, bool) {
+			lock.Lock()
+			reads++
+			lock.Unlock()
+
+			started <- struct{}{}
+			<-release
+
+			return "v", true
+		},
+	}
+
+	t.Setenv("PORTAL_GSETTINGS_TTL", "1m")
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			c.get("s", "k")
+		}()
+	}
+
+	<-started
+	// give the others time to find the call in flight
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if reads != 1 {
+		t.Errorf("%d reads for concurrent gets, want 1", reads)
+	}
+}
+
+func TestAcceptLabel(t *testing.T) {
+	for _, c := range []struct {
+		method  string
+		options kv
+		want    string
+	}{
+		{"OpenFile", kv{}, "_Open"},
+		{"OpenFile", kv{"directory": dbus.MakeVariant(true)}, "_Select"},
+		{"SaveFile", kv{}, "_Save"},
+		{"SaveFiles", kv{}, "_Save"},
+		{"SaveFile", kv{"directory": dbus.MakeVariant(true)}, "_Save"},
+		{"OpenFile", kv{"accept_label": dbus.MakeVariant("_Import")}, "_Import"},
+		{"SaveFile", kv{"accept_label": dbus.MakeVariant("_Export")}, "_Export"},
+		{"SaveFile", kv{"accept_label": dbus.MakeVariant("")}, "_Save"},
+	} {
+		if got := acceptLabel(c.method, c.options); got != c.want {
+			t.Errorf("acceptLabel(%s, %v) = %q, want %q", c.method, c.options, got, c.want)
+		}
+	}
+}
+
+// a FileManager1 that can not select anything
+type noSelection struct{}
+
+func (noSelection) ShowItems(uris []string, token string) *dbus.Error {
+	return dbus.NewError("org.freedesktop.DBus.Error.NotSupported", []any{"no selection"})
+}
+
+func TestOpenDirectoryWithoutSelection(t *testing.T) {
+	opened := make(chan string, 1)
+
+	b := startPortal(t, func(uri string, opts openOptions) openResult {
+		opened <- uri
+
+		return openResult{}
+	})
+
+	fm := testConn(t, b.addr)
+
+	if err := fm.Export(noSelection{}, "/org/freedesktop/FileManager1", "org.freedesktop.FileManager1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fm.RequestName("org.freedesktop.FileManager1", dbus.NameFlagDoNotQueue); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "doc.txt")
+
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	var handle dbus.ObjectPath
+
+	if err := b.obj.Call("org.freedesktop.portal.OpenURI.OpenDirectory", 0, "", dbus.UnixFD(f.Fd()), kv{}).Store(&handle); err != nil {
+		t.Fatal(err)
+	}
+
+	code, results, ok := b.response(t, handle, 5*time.Second)
+
+	if !ok || code != 0 {
+		t.Fatalf("OpenDirectory answered %d, %v, want 0", code, ok)
+	}
+
+	// the opener names no handler, so there is none to report
+	if _, found := results["handler"]; found {
+		t.Errorf("results %v, want no handler", results)
+	}
+
+	if uri := <-opened; uri != fileURI(dir) {
+		t.Errorf("opened %s, want the folder %s", uri, fileURI(dir))
+	}
+}
+
+func TestSaveFiles(t *testing.T) {
+	b := startPortal(t, nil)
+
+	dir := t.TempDir()
+
+	t.Setenv("PORTAL_FILECHOOSER_SAVE_AUTOANSWER", dir)
+	// no zenity to fall back to
+	t.Setenv("PATH", t.TempDir())
+
+	for _, options := range []kv{
+		{},
+		{"files": dbus.MakeVariant([][]byte{})},
+	} {
+		var handle dbus.ObjectPath
+
+		err := b.obj.Call("org.freedesktop.portal.FileChooser.SaveFiles", 0, "", "title", options).Store(&handle)
+
+		if dbusErrorName(err) != "org.freedesktop.portal.Error.InvalidArgument" {
+			t.Errorf("SaveFiles with %v: %v, want InvalidArgument", options, err)
+		}
+	}
+
+	if n := b.live(); n != 0 {
+		t.Errorf("%d requests left after refusing", n)
+	}
+
+	options := kv{
+		"handle_token": dbus.MakeVariant("files"),
+		"files":        dbus.MakeVariant([][]byte{[]byte("a.txt\x00"), []byte("b.txt\x00")}),
+	}
+
+	code, results := b.request(t, "org.freedesktop.portal.FileChooser.SaveFiles", "", "title", options)
+	uris, _ := results["uris"].Value().([]string)
+
+	if code != 0 || len(uris) != 2 || uris[0] != fileURI(filepath.Join(dir, "a.txt")) || uris[1] != fileURI(filepath.Join(dir, "b.txt")) {
+		t.Errorf("SaveFiles answered %d %v", code, uris)
+	}
+}
+
+func TestSchemeSupported(t *testing.T) {
+	fakePath(t, map[string]string{
+		"xdg-mime": `case "$3" in x-scheme-handler/https|x-scheme-handler/mailto) echo handler.desktop;; esac`,
+	})
+
+	t.Setenv("PORTAL_URI_SCHEMES", "")
+	t.Setenv("PORTAL_HANDLER_TTL", "0s")
+
+	b := startPortal(t, nil)
+
+	supported := func(scheme string) bool {
+		t.Helper()
+
+		var ok bool
+
+		if err := b.obj.Call(extNamespace+".OpenURI.SchemeSupported", 0, scheme).Store(&ok); err != nil {
+			t.Fatal(err)
+		}
+
+		return ok
+	}
+
+	for _, c := range []struct {
+		scheme string
+		want   bool
+	}{
+		{"https", true},
+		{"HTTPS", true},
+		{"file", true},
+		{"gopher", false},
+		{"", false},
+	} {
+		if got := supported(c.scheme); got != c.want {
+			t.Errorf("SchemeSupported(%q) = %v, want %v", c.scheme, got, c.want)
+		}
+	}
+
+	// a scheme with a handler is still unsupported outside the allowlist
+	t.Setenv("PORTAL_URI_SCHEMES", "https")
+
+	if supported("mailto") {
+		t.Error("mailto supported outside PORTAL_URI_SCHEMES")
+	}
+}
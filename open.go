@@ -0,0 +1,699 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"log"
+	"errors"
+	"sync"
+	"time"
+	"context"
+	"net/url"
+	"os/exec"
+	"strings"
+	"path/filepath"
+)
+
+// how OpenURI actually launches things
+
+type openOptions struct {
+	env []string
+	// the caller's PORTAL_DEPTH, for the loop guard
+	depth int
+	// app id of the caller, may be empty
+	app string
+	// of the uri, resolved once per open by resolveOpen
+	mime string
+	// desktop id picked in the ask chooser, overrides every default
+	handler string
+	// the request's, nil outside of one
+	logger  *log.Logger
+	ctx     context.Context
+	// bounds each dialog shown on the way, never the launcher
+	timeout time.Duration
+	// set by open --dry-run, gets the argv instead of it being run
+	dryRun  func(argv []string)
+}
+
+// launchers may stay in the foreground for as long as the app they start runs, so
+// only the start is waited for: an exit within PORTAL_OPEN_SPAWN_WAIT (2s) is the
+// result, one still running by then started fine and is left alone, never killed
+func (o openOptions) run(path string, args []string) error {
+	if o.dryRun != nil {
+		o.dryRun(append([]string{path}, args...))
+
+		return nil
+	}
+
+	cmd := exec.Command(path, args...)
+	cmd.Env = o.env
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	exited := make(chan error, 1)
+
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	wait, err := time.ParseDuration(config("OPEN_SPAWN_WAIT", "2s"))
+
+	if err != nil || wait <= 0 {
+		o.log().Println("bad PORTAL_OPEN_SPAWN_WAIT, use 2s")
+		wait = 2 * time.Second
+	}
+
+	select {
+	case err := <-exited:
+		return err
+	case <-time.After(wait):
+		o.log().Println(filepath.Base(path), "still running after", wait, "it started")
+	case <-o.context().Done():
+		o.log().Println("stop waiting for", filepath.Base(path), o.context().Err())
+	}
+
+	return nil
+}
+
+// a dialog's own deadline, unbounded when the caller set none
+func (o openOptions) dialogContext() (context.Context, context.CancelFunc) {
+	if o.timeout <= 0 {
+		return context.WithCancel(o.context())
+	}
+
+	return context.WithTimeout(o.context(), o.timeout)
+}
+
+func (o openOptions) context() context.Context {
+	if o.ctx != nil {
+		return o.ctx
+	}
+
+	return context.Background()
+}
+
+func (o openOptions) log() *log.Logger {
+	if o.logger != nil {
+		return o.logger
+	}
+
+	return log.Default()
+}
+
+// how an open ended: what handled the uri, or the Response code and why when
+// the user declined a chooser on the way
+type openResult struct {
+	handler string
+	// the program that ran, for the trace
+	backend string
+	code    uint32
+	reason  string
+}
+
+// the result names a handler only when the backend knows what it ran,
+// xdg-open and gio pick one themselves and leave it empty
+type OpenBackend interface {
+	Name() string
+	Open(uri string, opts openOptions) (openResult, error)
+}
+
+// fixed argv, uri goes last
+type commandBackend struct {
+	argv []string
+}
+
+func (b *commandBackend) Name() string {
+	return b.argv[0]
+}
+
+func (b *commandBackend) Open(uri string, opts openOptions) (openResult, error) {
+	path, err := exec.LookPath(b.argv[0])
+
+	if err != nil {
+		return openResult{}, err
+	}
+
+	return openResult{backend: b.argv[0]}, opts.run(path, append(b.argv[1:], uri))
+}
+
+// configured commands may say ~/bin/x or $HOME/bin/x; only the configured
+// text is expanded, never a uri or path substituted into it
+func expandCommand(s string) string {
+	return expandTilde(os.ExpandEnv(s))
+}
+
+// PORTAL_OPEN_COMMAND, %u is replaced by the uri, appended if absent
+type templateBackend struct {
+	template string
+}
+
+func (b *templateBackend) Name() string {
+	return "template"
+}
+
+func (b *templateBackend) argv(uri string) []string {
+	var res []string
+
+	found := false
+
+	for _, arg := range strings.Fields(b.template) {
+		arg = expandCommand(arg)
+
+		if strings.Contains(arg, "%u") {
+			arg = strings.ReplaceAll(arg, "%u", uri)
+			found = true
+		}
+
+		res = append(res, arg)
+	}
+
+	if !found {
+		res = append(res, uri)
+	}
+
+	return res
+}
+
+// the command is the handler, whatever it opens
+func (b *templateBackend) Open(uri string, opts openOptions) (openResult, error) {
+	argv := b.argv(uri)
+
+	if len(argv) == 0 {
+		return openResult{}, exec.ErrNotFound
+	}
+
+	path, err := exec.LookPath(argv[0])
+
+	if err != nil {
+		return openResult{}, err
+	}
+
+	name := filepath.Base(argv[0])
+
+	return openResult{handler: name, backend: name}, opts.run(path, argv[1:])
+}
+
+// PORTAL_OPEN_CHAIN, ";" separated commands in the PORTAL_OPEN_COMMAND format tried in
+// order; only a failure to exec falls through, a launcher that ran and failed does not
+type chainBackend struct {
+	links []*templateBackend
+}
+
+func (b *chainBackend) Name() string {
+	return "chain"
+}
+
+func (b *chainBackend) Open(uri string, opts openOptions) (openResult, error) {
+	err := error(exec.ErrNotFound)
+
+	for _, link := range b.links {
+		var res openResult
+
+		res, err = link.Open(uri, opts)
+
+		var exit *exec.ExitError
+
+		if err == nil || errors.As(err, &exit) {
+			opts.log().Println("open chain ran", link.template)
+
+			return res, err
+		}
+
+		opts.log().Println("open chain skips", link.template, err)
+	}
+
+	return openResult{}, err
+}
+
+func openChain(chain string) *chainBackend {
+	res := &chainBackend{}
+
+	for _, tmpl := range strings.Split(chain, ";") {
+		if tmpl = strings.TrimSpace(tmpl); tmpl != "" {
+			res.links = append(res.links, &templateBackend{template: tmpl})
+		}
+	}
+
+	return res
+}
+
+var openBackends = []OpenBackend{
+	&commandBackend{argv: []string{"xdg-open-dispatch"}},
+	&commandBackend{argv: []string{"xdg-open"}},
+	&commandBackend{argv: []string{"gio", "open"}},
+}
+
+// PORTAL_OPEN_BACKEND names a backend, PORTAL_OPEN_COMMAND configures the template one,
+// PORTAL_OPEN_CHAIN the chain one, otherwise the first backend found on PATH wins
+func selectOpenBackend() OpenBackend {
+	name := config("OPEN_BACKEND", "")
+
+	if chain := config("OPEN_CHAIN", ""); chain != "" && (name == "" || name == "chain") {
+		return openChain(chain)
+	}
+
+	if tmpl := config("OPEN_COMMAND", ""); tmpl != "" && (name == "" || name == "template") {
+		return &templateBackend{template: tmpl}
+	}
+
+	for _, b := range openBackends {
+		if name == b.Name() {
+			return b
+		}
+	}
+
+	if name != "" {
+		fmtException("unknown PORTAL_OPEN_BACKEND %s", name).withCode(exitConfig).throw()
+	}
+
+	for _, b := range openBackends {
+		if _, err := exec.LookPath(b.Name()); err == nil {
+			return b
+		}
+	}
+
+	fmtException("no open backend found, tried xdg-open-dispatch, xdg-open and gio").throw()
+
+	return nil
+}
+
+func activeOpenBackend() (name string) {
+	try(func() {
+		name = selectOpenBackend().Name()
+	}).catch(func(exc *Exception) {
+		name = ""
+	})
+
+	return name
+}
+
+// opts.mime is set by resolveOpen, an open from noHandler keeps it
+func xdgOpen(url string, opts openOptions) openResult {
+	var backend OpenBackend
+
+	desktop := opts.handler
+
+	// a per app override beats the global default
+	if desktop == "" {
+		desktop = appHandler(opts.app, opts.mime)
+	}
+
+	if desktop != "" {
+		backend = &commandBackend{argv: []string{"gtk-launch", desktop}}
+		opts.log().Println("open", url, "with", desktop)
+	} else {
+		backend = selectOpenBackend()
+		opts.log().Println("open", url, "with", backend.Name())
+	}
+
+	res, err := backend.Open(url, opts)
+
+	if err != nil {
+		var exit *exec.ExitError
+
+		// it ran and failed with nothing registered, the usual "no application" case
+		if _, plain := backend.(*commandBackend); plain && errors.As(err, &exit) && desktop == "" && mimeHandler(opts.mime) == "" {
+			return noHandler(url, opts, backend.Name(), err)
+		}
+
+		if errors.As(err, &exit) {
+			fmtException("%s: %v", backend.Name(), err).throw()
+		}
+
+		fmtException("%s", execError(backend.Name(), err)).throw()
+	}
+
+	if desktop != "" {
+		res.handler = desktop
+	}
+
+	return res
+}
+
+// the one way from a uri to the backend, OpenURI and portal open alike: the scheme
+// and loop checks, the confirm for programs and the ask chooser, in that order, so
+// an open that would be refused never asks the user anything first
+func resolveOpen(opener func(string, openOptions) openResult, uri string, ask bool, opts openOptions) openResult {
+	checkOpen(uri, opts.depth)
+
+	opts.mime = uriMimeType(uri)
+
+	if danger := dangerousFile(uri, opts.mime); danger != "" && opts.dryRun != nil {
+		opts.log().Println("dry run, would confirm", uri, "first,", danger)
+	} else if danger != "" {
+		opts.log().Println("confirm", uri, "first,", danger)
+
+		ctx, cancel := opts.dialogContext()
+		code, reason := confirmOpen(ctx, uri, danger)
+		cancel()
+
+		if code != 0 {
+			return openResult{code: code, reason: "confirm " + reason}
+		}
+	}
+
+	if ask {
+		ctx, cancel := opts.dialogContext()
+		chosen, code, reason := askHandler(ctx, uri, opts.mime)
+		cancel()
+
+		if code != 0 {
+			return openResult{code: code, reason: "ask " + reason}
+		}
+
+		opts.handler = chosen
+	}
+
+	return opener(uri, opts)
+}
+
+// PORTAL_NO_HANDLER=ask offers the ask chooser when nothing is set to open the uri,
+// by default the request fails saying so instead of whatever the backend printed;
+// declining the chooser is the user's answer and ends in its code, not a failure
+func noHandler(url string, opts openOptions, backend string, err error) openResult {
+	opts.log().Println(backend, "failed with no default handler for", url, err)
+
+	if mode := config("NO_HANDLER", "fail"); mode == "ask" {
+		ctx, cancel := opts.dialogContext()
+		defer cancel()
+
+		chosen, code, reason := askHandler(ctx, url, opts.mime)
+
+		if code != 0 {
+			return openResult{code: code, reason: fmt.Sprintf("no default handler for %s, ask: %s", url, reason)}
+		}
+
+		opts.handler = chosen
+
+		return xdgOpen(url, opts)
+	} else if mode != "fail" {
+		opts.log().Println("bad PORTAL_NO_HANDLER", mode, "want ask or fail")
+	}
+
+	fmtException("not found: no application is set to open %s (%s)", url, opts.mime).throw()
+
+	return openResult{}
+}
+
+// $XDG_CONFIG_HOME/portal/mimeapps/<app-id>.list, [Default Applications] as in mimeapps.list
+func appHandler(app string, mime string) (res string) {
+	if app == "" || mime == "" || strings.ContainsRune(app, '/') || strings.HasPrefix(app, ".") {
+		return ""
+	}
+
+	try(func() {
+		data, err := os.ReadFile(filepath.Join(configHome(), "portal", "mimeapps", app+".list"))
+
+		if err != nil {
+			return
+		}
+
+		section := ""
+
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+
+			if strings.HasPrefix(line, "[") {
+				section = line
+
+				continue
+			}
+
+			key, val, ok := strings.Cut(line, "=")
+
+			if !ok || section != "[Default Applications]" || strings.TrimSpace(key) != mime {
+				continue
+			}
+
+			for _, desktop := range strings.Split(val, ";") {
+				if desktop = strings.TrimSpace(desktop); desktop != "" {
+					res = desktop
+
+					return
+				}
+			}
+		}
+	}).catch(func(exc *Exception) {
+		log.Println("in appHandler", exc.what())
+	})
+
+	return res
+}
+
+func queryHandler(mime string) string {
+	out, err := exec.Command("xdg-mime", "query", "default", mime).Output()
+
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+func mimeappsMtime() (res time.Time) {
+	try(func() {
+		if st, err := os.Stat(filepath.Join(configHome(), "mimeapps.list")); err == nil {
+			res = st.ModTime()
+		}
+	}).catch(func(exc *Exception) {
+		log.Println("in mimeappsMtime", exc.what())
+	})
+
+	return res
+}
+
+type handlerCall struct {
+	done    chan struct{}
+	handler string
+	at      time.Time
+	mtime   time.Time
+}
+
+// per mime type singleflight, concurrent lookups share one xdg-mime run;
+// entries expire after PORTAL_HANDLER_TTL or when mimeapps.list changes
+type handlerCache struct {
+	lock  sync.Mutex
+	calls map[string]*handlerCall
+	query func(string) string
+}
+
+var handlers = &handlerCache{
+	calls: map[string]*handlerCall{},
+	query: queryHandler,
+}
+
+func (c *handlerCache) stale(call *handlerCall, mtime time.Time) bool {
+	select {
+	case <-call.done:
+	default:
+		// in flight, join it
+		return false
+	}
+
+	ttl, err := time.ParseDuration(config("HANDLER_TTL", "1m"))
+
+	if err != nil {
+		ttl = time.Minute
+	}
+
+	return time.Since(call.at) > ttl || !call.mtime.Equal(mtime)
+}
+
+func (c *handlerCache) get(mime string) string {
+	mtime := mimeappsMtime()
+
+	c.lock.Lock()
+
+	call, ok := c.calls[mime]
+
+	if ok && !c.stale(call, mtime) {
+		c.lock.Unlock()
+		<-call.done
+
+		return call.handler
+	}
+
+	call = &handlerCall{
+		done:  make(chan struct{}),
+		mtime: mtime,
+	}
+
+	c.calls[mime] = call
+
+	c.lock.Unlock()
+
+	defer close(call.done)
+
+	call.handler = c.query(mime)
+	call.at = time.Now()
+
+	return call.handler
+}
+
+func schemeHandler(scheme string) string {
+	return handlers.get("x-scheme-handler/" + scheme)
+}
+
+func fileMimeType(path string) string {
+	out, err := exec.Command("xdg-mime", "query", "filetype", path).Output()
+
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+// "Registered applications:" section of gio mime, one tab indented desktop id per line
+func registeredHandlers(mime string) []string {
+	out, err := exec.Command("gio", "mime", mime).Output()
+
+	if err != nil {
+		return nil
+	}
+
+	var res []string
+
+	section := ""
+
+	for _, line := range strings.Split(string(out), "\n") {
+		if !strings.HasPrefix(line, "\t") {
+			section = strings.TrimSpace(line)
+
+			continue
+		}
+
+		if section == "Registered applications:" {
+			res = append(res, strings.TrimSpace(line))
+		}
+	}
+
+	return res
+}
+
+// the ask option, zenity lists the registered handlers; a non zero code is the
+// cancel or failure the Response reports, declining opens nothing
+func askHandler(ctx context.Context, uri string, mime string) (string, uint32, string) {
+	if mime == "" {
+		return "", 2, fmt.Sprintf("not found: can not tell the type of %s", uri)
+	}
+
+	// an empty chooser is no choice, fail instead of showing one
+	apps := registeredHandlers(mime)
+
+	if len(apps) == 0 {
+		return "", 2, fmt.Sprintf("not found: no application available to open %s", mime)
+	}
+
+	// a uri is no markup, & or < in one would break the dialog
+	args := []string{"--list", "--title=Open With", "--no-markup", "--text=" + uri, "--column=Application", "--hide-header"}
+
+	cmd := helperCommand(ctx, "zenity", append(args, apps...)...)
+	cmd.Env = dialogEnv()
+
+	out, err := cmd.Output()
+
+	if err != nil {
+		code, reason := exitResponse("zenity", err)
+
+		return "", code, reason
+	}
+
+	desktop := strings.TrimSpace(string(out))
+
+	// OK with nothing selected is a decline too
+	if desktop == "" {
+		return "", 1, "nothing chosen"
+	}
+
+	return desktop, 0, ""
+}
+
+// opened, these run code rather than show a document
+var dangerousExtensions = map[string]bool{
+	".sh":       true,
+	".bash":     true,
+	".zsh":      true,
+	".py":       true,
+	".pl":       true,
+	".rb":       true,
+	".jar":      true,
+	".appimage": true,
+	".run":      true,
+	".exe":      true,
+	".bat":      true,
+	".cmd":      true,
+	".msi":      true,
+}
+
+// why opening uri of type mime could run a program, "" for documents and non file uris
+func dangerousFile(uri string, mime string) string {
+	u, err := url.Parse(uri)
+
+	if err != nil || strings.ToLower(u.Scheme) != "file" {
+		return ""
+	}
+
+	ext := strings.ToLower(filepath.Ext(u.Path))
+
+	if ext == ".desktop" || mime == "application/x-desktop" {
+		return "it is a desktop entry, which launches a program"
+	}
+
+	if dangerousExtensions[ext] {
+		return fmt.Sprintf("%s files are programs or scripts", ext)
+	}
+
+	if st, err := os.Stat(u.Path); err == nil && st.Mode().IsRegular() && st.Mode().Perm()&0111 != 0 {
+		return "it is executable"
+	}
+
+	return ""
+}
+
+// asked whatever the ask option says, a link should never run a program unseen;
+// the code is the Response's, 1 when the user says no
+func confirmOpen(ctx context.Context, uri string, reason string) (uint32, string) {
+	text := fmt.Sprintf("Open %s?\n\nThis may run a program: %s.", uri, reason)
+
+	cmd := helperCommand(ctx, "zenity", "--question", "--title=Open Program", "--no-markup", "--text="+text)
+	cmd.Env = dialogEnv()
+
+	if err := cmd.Run(); err != nil {
+		code, why := exitResponse("zenity", err)
+
+		if code == 1 {
+			why = "declined"
+		}
+
+		return code, why
+	}
+
+	return 0, ""
+}
+
+// x-scheme-handler/<scheme> for non file uris
+func uriMimeType(uri string) string {
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return ""
+	}
+
+	if u.Scheme != "file" {
+		return "x-scheme-handler/" + strings.ToLower(u.Scheme)
+	}
+
+	return fileMimeType(u.Path)
+}
+
+// the xdg default for mime, through the handler cache
+func mimeHandler(mime string) string {
+	if mime == "" {
+		return ""
+	}
+
+	return handlers.get(mime)
+}
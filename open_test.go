@@ -0,0 +1,567 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+	"sync/atomic"
+	"path/filepath"
+	"github.com/godbus/dbus/v5"
+)
+
+// PATH holding only the given fake helpers, plus sh for them to run with
+func fakePath(t *testing.T, scripts map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	for name, body := range scripts {
+		writeScript(t, dir, name, body)
+	}
+
+	t.Setenv("PATH", dir+":/bin:/usr/bin")
+
+	return dir
+}
+
+func TestHandlerCache(t *testing.T) {
+	dir := isolate(t)
+
+	var runs int32
+
+	release := make(chan struct{})
+
+	c := &handlerCache{
+		calls: map[string]*handlerCall{},
+		query: func(mime string) string {
+			atomic.AddInt32(&runs, 1)
+			<-release
+
+			return "handler-for-" + mime
+		},
+	}
+
+	var wg sync.WaitGroup
+
+	got := make(chan string, 8)
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			got <- c.get("text/plain")
+		}()
+	}
+
+	// let every lookup find the one in flight
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(got)
+
+	for handler := range got {
+		if handler != "handler-for-text/plain" {
+			t.Errorf("joined lookup got %q", handler)
+		}
+	}
+
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Errorf("concurrent lookups ran xdg-mime %d times, want 1", n)
+	}
+
+	c.get("text/plain")
+	c.get("image/png")
+
+	if n := atomic.LoadInt32(&runs); n != 2 {
+		t.Errorf("%d runs, want a cached text/plain and one for image/png", n)
+	}
+
+	// a changed mimeapps.list drops what was cached
+	list := filepath.Join(dir, "config", "mimeapps.list")
+
+	if err := os.MkdirAll(filepath.Dir(list), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(list, []byte("[Default Applications]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c.get("text/plain")
+
+	if n := atomic.LoadInt32(&runs); n != 3 {
+		t.Errorf("%d runs, want one more after mimeapps.list changed", n)
+	}
+
+	t.Setenv("PORTAL_HANDLER_TTL", "1ns")
+
+	c.get("text/plain")
+
+	if n := atomic.LoadInt32(&runs); n != 4 {
+		t.Errorf("%d runs, want one more once the entry expired", n)
+	}
+}
+
+func TestAppHandler(t *testing.T) {
+	dir := isolate(t)
+	lists := filepath.Join(dir, "config", "portal", "mimeapps")
+
+	if err := os.MkdirAll(lists, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	list := strings.Join([]string{
+		"[Added Associations]",
+		"image/png=viewer.desktop",
+		"[Default Applications]",
+		"text/plain = ;first.desktop;second.desktop",
+		"",
+	}, "\n")
+
+	if err := os.WriteFile(filepath.Join(lists, "org.example.App.list"), []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		app  string
+		mime string
+		want string
+	}{
+		{"org.example.App", "text/plain", "first.desktop"},
+		{"org.example.App", "image/png", ""},
+		{"org.example.Other", "text/plain", ""},
+		{"", "text/plain", ""},
+		{"org.example.App", "", ""},
+		{"../mimeapps/org.example.App", "text/plain", ""},
+	} {
+		if got := appHandler(c.app, c.mime); got != c.want {
+			t.Errorf("appHandler(%q, %q) = %q, want %q", c.app, c.mime, got, c.want)
+		}
+	}
+}
+
+func TestResolveOpenRefusesBeforeAsking(t *testing.T) {
+	dir := fakePath(t, nil)
+	asked := filepath.Join(dir, "asked")
+
+	writeScript(t, dir, "zenity", "touch "+asked+"; exit 0")
+	writeScript(t, dir, "gio", `printf 'Registered applications:\n\tx.desktop\n'`)
+
+	t.Setenv("PORTAL_URI_SCHEMES", "https")
+	t.Setenv("PORTAL_MAX_DEPTH", "2")
+
+	opened := false
+
+	opener := func(uri string, opts openOptions) openResult {
+		opened = true
+
+		return openResult{}
+	}
+
+	for _, c := range []struct {
+		uri   string
+		depth int
+		want  string
+	}{
+		{"ftp://example.org/", 0, `scheme "ftp" of ftp://example.org/ is not allowed`},
+		{"https://example.org/", 2, "loop detected: caller reached portal depth 2"},
+	} {
+		exc := try(func() {
+			resolveOpen(opener, c.uri, true, openOptions{logger: quiet, depth: c.depth})
+		})
+
+		if exc == nil || !strings.HasPrefix(exc.what().Error(), c.want) {
+			t.Errorf("%s at depth %d: %v, want %s", c.uri, c.depth, exc, c.want)
+		}
+	}
+
+	if opened {
+		t.Error("opener ran for a refused uri")
+	}
+
+	if _, err := os.Stat(asked); err == nil {
+		t.Error("the user was asked about a refused uri")
+	}
+}
+
+func TestResolveOpenDeclined(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "run.sh")
+
+	if err := os.WriteFile(script, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fakePath(t, map[string]string{
+		"gio":    `printf 'Registered applications:\n\tone.desktop\n'`,
+		"zenity": "exit 1",
+	})
+
+	t.Setenv("PORTAL_URI_SCHEMES", "")
+
+	opener := func(uri string, opts openOptions) openResult {
+		t.Errorf("opened %s after a decline", uri)
+
+		return openResult{}
+	}
+
+	if res := resolveOpen(opener, fileURI(script), false, openOptions{logger: quiet}); res.code != 1 || res.reason != "confirm declined" {
+		t.Errorf("declined confirm: %+v, want code 1", res)
+	}
+
+	if res := resolveOpen(opener, "https://example.org/", true, openOptions{logger: quiet}); res.code != 1 {
+		t.Errorf("declined ask: %+v, want code 1", res)
+	}
+}
+
+// an OpenBackend that remembers what it was asked to open
+type fakeBackend struct {
+	name string
+	uris []string
+}
+
+func (b *fakeBackend) Name() string {
+	return b.name
+}
+
+func (b *fakeBackend) Open(uri string, opts openOptions) (openResult, error) {
+	b.uris = append(b.uris, uri)
+
+	return openResult{backend: b.name}, nil
+}
+
+func TestOpenBackend(t *testing.T) {
+	isolate(t)
+	fakePath(t, nil)
+
+	fake := &fakeBackend{name: "fake"}
+
+	old := openBackends
+	openBackends = append([]OpenBackend{fake}, old...)
+
+	t.Cleanup(func() {
+		openBackends = old
+	})
+
+	t.Setenv("PORTAL_OPEN_CHAIN", "")
+	t.Setenv("PORTAL_OPEN_COMMAND", "")
+	t.Setenv("PORTAL_OPEN_BACKEND", "fake")
+
+	if got := activeOpenBackend(); got != "fake" {
+		t.Errorf("activeOpenBackend = %q, want fake", got)
+	}
+
+	res := xdgOpen("https://example.org/?q=1", openOptions{logger: quiet})
+
+	if len(fake.uris) != 1 || fake.uris[0] != "https://example.org/?q=1" || res.backend != "fake" {
+		t.Errorf("fake backend got %v, result %+v", fake.uris, res)
+	}
+
+	t.Setenv("PORTAL_OPEN_BACKEND", "bogus")
+
+	if exc := try(func() { selectOpenBackend() }); exc == nil || exc.code != exitConfig {
+		t.Errorf("unknown backend: %v, want a config error", exc)
+	}
+}
+
+func TestAskNoApplication(t *testing.T) {
+	dir := fakePath(t, map[string]string{
+		"gio": `printf 'Default application for x-scheme-handler/https:\nRegistered applications:\nRecommended applications:\n'`,
+	})
+
+	asked := filepath.Join(dir, "asked")
+
+	writeScript(t, dir, "zenity", `case "$*" in *--list*) touch `+asked+`;; esac`)
+
+	t.Setenv("PORTAL_URI_SCHEMES", "")
+
+	opener := func(uri string, opts openOptions) openResult {
+		t.Errorf("opened %s with nothing to open it", uri)
+
+		return openResult{}
+	}
+
+	res := resolveOpen(opener, "https://example.org/", true, openOptions{logger: quiet})
+
+	if res.code != 2 || res.reason != "ask not found: no application available to open x-scheme-handler/https" {
+		t.Errorf("no registered application: %+v, want code 2", res)
+	}
+
+	b := startPortal(t, opener)
+
+	var handle dbus.ObjectPath
+
+	options := kv{
+		"handle_token": dbus.MakeVariant("ask"),
+		"ask":          dbus.MakeVariant(true),
+	}
+
+	if err := b.obj.Call("org.freedesktop.portal.OpenURI.OpenURI", 0, "", "https://example.org/", options).Store(&handle); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, _, ok := b.response(t, handle, 5*time.Second); !ok || code != 2 {
+		t.Errorf("OpenURI answered %d, %v, want 2", code, ok)
+	}
+
+	if _, err := os.Stat(asked); err == nil {
+		t.Error("an empty chooser was shown")
+	}
+}
+
+func TestChainFallthrough(t *testing.T) {
+	dir := fakePath(t, map[string]string{
+		"second": "exit 0",
+		"fails":  "exit 3",
+	})
+
+	chain := openChain("missing-tool %u; second --x %u ;")
+
+	if len(chain.links) != 2 {
+		t.Fatalf("%d links, want 2", len(chain.links))
+	}
+
+	res, err := chain.Open("https://a/", openOptions{logger: quiet})
+
+	if err != nil || res.handler != "second" || res.backend != "second" {
+		t.Errorf("chain ran %+v, %v, want second", res, err)
+	}
+
+	// a launcher that ran and failed is the answer, the next link is not tried
+	marker := filepath.Join(dir, "ran")
+	writeScript(t, dir, "third", "touch "+marker)
+
+	_, err = openChain("fails %u; third %u").Open("https://a/", openOptions{logger: quiet})
+
+	var exit *exec.ExitError
+
+	if !errors.As(err, &exit) {
+		t.Errorf("failing link: %v, want its exit error", err)
+	}
+
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("chain went on after a link that ran")
+	}
+
+	if _, err := openChain("missing-a; missing-b").Open("https://a/", openOptions{logger: quiet}); !errors.Is(err, exec.ErrNotFound) {
+		t.Errorf("no link found: %v, want ErrNotFound", err)
+	}
+}
+
+func TestRunSpawnWait(t *testing.T) {
+	dir := fakePath(t, map[string]string{
+		"stays":  "sleep 10",
+		"fails":  "exit 3",
+		"starts": "exit 0",
+	})
+
+	t.Setenv("PORTAL_OPEN_SPAWN_WAIT", "200ms")
+
+	opts := openOptions{logger: quiet}
+
+	start := time.Now()
+
+	if err := opts.run(filepath.Join(dir, "stays"), nil); err != nil {
+		t.Errorf("launcher still running: %v", err)
+	}
+
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("waited %v for a launcher in the foreground", d)
+	}
+
+	var exit *exec.ExitError
+
+	if err := opts.run(filepath.Join(dir, "fails"), nil); !errors.As(err, &exit) || exit.ExitCode() != 3 {
+		t.Errorf("failing launcher: %v, want exit 3", err)
+	}
+
+	if err := opts.run(filepath.Join(dir, "starts"), nil); err != nil {
+		t.Errorf("launcher exiting 0: %v", err)
+	}
+}
+
+func TestNoHandler(t *testing.T) {
+	fakePath(t, map[string]string{
+		"gio":    `printf 'Registered applications:\n\tone.desktop\n'`,
+		"zenity": "exit 1",
+	})
+
+	opts := openOptions{
+		logger: quiet,
+		mime:   "x-scheme-handler/foo",
+	}
+
+	t.Setenv("PORTAL_NO_HANDLER", "ask")
+
+	if res := noHandler("foo:bar", opts, "xdg-open", errors.New("exit status 4")); res.code != 1 {
+		t.Errorf("declined chooser: %+v, want code 1", res)
+	}
+
+	t.Setenv("PORTAL_NO_HANDLER", "fail")
+
+	exc := try(func() {
+		noHandler("foo:bar", opts, "xdg-open", errors.New("exit status 4"))
+	})
+
+	if exc == nil || !strings.HasPrefix(exc.what().Error(), "not found: no application is set to open foo:bar") {
+		t.Errorf("fail mode: %v", exc)
+	}
+}
+
+func TestDangerousFile(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]os.FileMode{
+		"run.sh":      0644,
+		"Setup.EXE":   0644,
+		"app.desktop": 0644,
+		"entry":       0644,
+		"tool":        0755,
+		"report.pdf":  0644,
+		"notes.txt":   0644,
+	}
+
+	for name, mode := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		uri  string
+		mime string
+		want string
+	}{
+		{fileURI(filepath.Join(dir, "run.sh")), "application/x-shellscript", ".sh files are programs or scripts"},
+		{fileURI(filepath.Join(dir, "Setup.EXE")), "", ".exe files are programs or scripts"},
+		{fileURI(filepath.Join(dir, "app.desktop")), "", "it is a desktop entry, which launches a program"},
+		{fileURI(filepath.Join(dir, "entry")), "application/x-desktop", "it is a desktop entry, which launches a program"},
+		{fileURI(filepath.Join(dir, "tool")), "application/octet-stream", "it is executable"},
+		{fileURI(filepath.Join(dir, "report.pdf")), "application/pdf", ""},
+		{fileURI(filepath.Join(dir, "notes.txt")), "text/plain", ""},
+		{fileURI(dir), "inode/directory", ""},
+		{"https://example.org/install.sh", "x-scheme-handler/https", ""},
+	} {
+		if got := dangerousFile(c.uri, c.mime); got != c.want {
+			t.Errorf("dangerousFile(%s) = %q, want %q", c.uri, got, c.want)
+		}
+	}
+}
+
+func TestTemplateArgv(t *testing.T) {
+	t.Setenv("HOME", "/home/u")
+	t.Setenv("TOOLS", "/opt/tools")
+
+	for _, c := range []struct {
+		template string
+		uri      string
+		want     string
+	}{
+		{"browser --new-tab %u", "https://a/", "browser|--new-tab|https://a/"},
+		{"browser", "https://a/", "browser|https://a/"},
+		{"~/bin/open --url=%u", "https://a/", "/home/u/bin/open|--url=https://a/"},
+		{"$TOOLS/open --profile=~/p %u", "https://a/", "/opt/tools/open|--profile=~/p|https://a/"},
+		{"${TOOLS}/open", "https://a/", "/opt/tools/open|https://a/"},
+		// the uri is substituted after expansion, never expanded itself
+		{"~/bin/open %u", "file:///x/$HOME/~", "/home/u/bin/open|file:///x/$HOME/~"},
+		{"open", "~/$TOOLS", "open|~/$TOOLS"},
+	} {
+		got := strings.Join((&templateBackend{template: c.template}).argv(c.uri), "|")
+
+		if got != c.want {
+			t.Errorf("argv(%q, %q) = %s, want %s", c.template, c.uri, got, c.want)
+		}
+	}
+}
+
+func TestXdgOpenDryRun(t *testing.T) {
+	isolate(t)
+	fakePath(t, map[string]string{
+		"browser": "exit 0",
+	})
+
+	t.Setenv("PORTAL_OPEN_BACKEND", "")
+	t.Setenv("PORTAL_OPEN_CHAIN", "")
+	t.Setenv("PORTAL_OPEN_COMMAND", "browser --new %u")
+
+	var argv []string
+
+	res := xdgOpen("https://a/", openOptions{
+		logger: quiet,
+		mime:   "x-scheme-handler/https",
+		dryRun: func(a []string) {
+			argv = a
+		},
+	})
+
+	if len(argv) != 3 || filepath.Base(argv[0]) != "browser" || argv[1] != "--new" || argv[2] != "https://a/" {
+		t.Errorf("dry run argv %v", argv)
+	}
+
+	if res.handler != "browser" {
+		t.Errorf("handler %q, want browser", res.handler)
+	}
+}
+
+func TestResolveOpen(t *testing.T) {
+	fakePath(t, map[string]string{
+		"gio":    `printf 'Default application for x:\n\tx.desktop\nRegistered applications:\n\tone.desktop\n\ttwo.desktop\n'`,
+		"zenity": `case "$*" in *--list*) echo two.desktop;; esac`,
+	})
+
+	t.Setenv("PORTAL_URI_SCHEMES", "")
+
+	var got openOptions
+
+	opener := func(uri string, opts openOptions) openResult {
+		got = opts
+
+		return openResult{handler: opts.handler}
+	}
+
+	res := resolveOpen(opener, "https://example.org/", false, openOptions{logger: quiet})
+
+	if res.code != 0 || got.mime != "x-scheme-handler/https" || got.handler != "" {
+		t.Errorf("plain open: %+v with %+v", res, got)
+	}
+
+	res = resolveOpen(opener, "https://example.org/", true, openOptions{logger: quiet})
+
+	if res.code != 0 || res.handler != "two.desktop" {
+		t.Errorf("ask: %+v, want two.desktop chosen", res)
+	}
+}
+
+func TestResolveOpenDryRunSkipsConfirm(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "run.sh")
+
+	if err := os.WriteFile(script, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// no zenity, a real confirm would fail
+	fakePath(t, map[string]string{})
+
+	var opened string
+
+	opener := func(uri string, opts openOptions) openResult {
+		opened = uri
+
+		return openResult{}
+	}
+
+	opts := openOptions{
+		logger: quiet,
+		dryRun: func([]string) {},
+	}
+
+	if res := resolveOpen(opener, fileURI(script), false, opts); res.code != 0 || opened != fileURI(script) {
+		t.Errorf("dry run of a script: %+v, opened %q", res, opened)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"bytes"
+	"context"
+	"strings"
+	"encoding/json"
+)
+
+// PORTAL_FILECHOOSER_PLUGIN=<executable> replaces zenity. The plugin reads one json
+// object on stdin:
+//
+//	{"method": "OpenFile", "app": "org.example.App", "title": "...", "multiple": true, "options": {...}}
+//
+// and answers one json object on stdout:
+//
+//	{"response": 0, "paths": ["/home/user/a.txt"]}
+//
+// response follows the Request.Response codes, 0 with no paths counts as cancel;
+// byte string options (current_folder, current_file) arrive as plain strings
+
+type pluginRequest struct {
+	Method   string         `json:"method"`
+	App      string         `json:"app"`
+	Title    string         `json:"title"`
+	Multiple bool           `json:"multiple"`
+	Options  map[string]any `json:"options"`
+}
+
+type pluginResponse struct {
+	Response uint32   `json:"response"`
+	Paths    []string `json:"paths"`
+}
+
+func pluginOptions(options kv) map[string]any {
+	res := map[string]any{}
+
+	for key, val := range options {
+		if b, ok := val.Value().([]byte); ok {
+			res[key] = strings.TrimRight(string(b), "\x00")
+		} else {
+			res[key] = val.Value()
+		}
+	}
+
+	return res
+}
+
+// errors are from running the plugin, a bad answer is a failure response
+func runPlugin(ctx context.Context, plugin string, call *dialogCall) (uint32, []string, error) {
+	in, err := json.Marshal(&pluginRequest{
+		Method:   call.method,
+		App:      call.app,
+		Title:    call.title,
+		Multiple: call.multiple,
+		Options:  pluginOptions(call.options),
+	})
+
+	if err != nil {
+		return 2, nil, fmt.Errorf("can not encode plugin request: %w", err)
+	}
+
+	cmd := helperCommand(ctx, plugin)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Env = dialogEnv()
+
+	out, err := cmd.Output()
+
+	if err != nil {
+		return 2, nil, err
+	}
+
+	var res pluginResponse
+
+	if err := json.Unmarshal(out, &res); err != nil {
+		return 2, nil, fmt.Errorf("bad plugin answer %q: %w", out, err)
+	}
+
+	if res.Response > 2 {
+		return 2, nil, fmt.Errorf("bad plugin response code %d", res.Response)
+	}
+
+	return res.Response, res.Paths, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"context"
+	"strings"
+	"testing"
+	"encoding/json"
+	"path/filepath"
+	"github.com/godbus/dbus/v5"
+)
+
+func TestRunPlugin(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "request.json")
+
+	call := &dialogCall{
+		method:   "OpenFile",
+		app:      "org.example.App",
+		title:    "Pick",
+		multiple: true,
+		options: kv{
+			"current_folder": dbus.MakeVariant([]byte("/home/u\x00")),
+			"modal":          dbus.MakeVariant(true),
+		},
+	}
+
+	plugin := writeScript(t, dir, "plugin", `cat > `+input+`
+echo '{"response": 0, "paths": ["/home/u/a.txt", "/home/u/b c.txt"]}'`)
+
+	code, paths, err := runPlugin(context.Background(), plugin, call)
+
+	if err != nil || code != 0 || strings.Join(paths, "|") != "/home/u/a.txt|/home/u/b c.txt" {
+		t.Errorf("runPlugin = %d %q %v", code, paths, err)
+	}
+
+	data, _ := os.ReadFile(input)
+
+	var req pluginRequest
+
+	if err := json.Unmarshal(data, &req); err != nil {
+		t.Fatalf("plugin got %q: %v", data, err)
+	}
+
+	if req.Method != "OpenFile" || req.App != "org.example.App" || req.Title != "Pick" || !req.Multiple {
+		t.Errorf("plugin request %+v", req)
+	}
+
+	if req.Options["current_folder"] != "/home/u" || req.Options["modal"] != true {
+		t.Errorf("plugin options %v, want byte strings as plain strings", req.Options)
+	}
+
+	for _, c := range []struct {
+		name   string
+		script string
+	}{
+		{"not json", "echo oops"},
+		{"bad code", `echo '{"response": 7}'`},
+		{"exit", "exit 3"},
+	} {
+		plugin := writeScript(t, dir, "plugin", c.script)
+
+		if code, paths, err := runPlugin(context.Background(), plugin, call); err == nil || code != 2 || paths != nil {
+			t.Errorf("%s: runPlugin = %d %q %v, want a failure", c.name, code, paths, err)
+		}
+	}
+
+	// cancel is an answer, not a plugin failure
+	plugin = writeScript(t, dir, "plugin", `echo '{"response": 1}'`)
+
+	if code, _, err := runPlugin(context.Background(), plugin, call); err != nil || code != 1 {
+		t.Errorf("cancel: runPlugin = %d %v", code, err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"reflect"
+	"strconv"
+	"strings"
+	"github.com/godbus/dbus/v5"
+)
+
+// PORTAL_ALLOWED_PEERS, comma separated uids and bus names (unique or well-known)
+// allowed to call the portal at all; empty allows everybody
+
+func allowedPeers() []string {
+	var res []string
+
+	for _, peer := range strings.Split(config("ALLOWED_PEERS", ""), ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			res = append(res, peer)
+		}
+	}
+
+	return res
+}
+
+func peerAllowed(conn *dbus.Conn, sender string) bool {
+	peers := allowedPeers()
+
+	if len(peers) == 0 {
+		return true
+	}
+
+	uid := int64(-1)
+
+	for _, peer := range peers {
+		if want, err := strconv.ParseUint(peer, 10, 32); err == nil {
+			if uid < 0 {
+				var res uint32
+
+				if err := conn.BusObject().Call("org.freedesktop.DBus.GetConnectionUnixUser", 0, sender).Store(&res); err != nil {
+					log.Println("can not get uid of", sender, err)
+
+					return false
+				}
+
+				uid = int64(res)
+			}
+
+			if uint64(uid) == want {
+				return true
+			}
+
+			continue
+		}
+
+		if peer == sender {
+			return true
+		}
+
+		var owner string
+
+		if !strings.HasPrefix(peer, ":") && conn.BusObject().Call("org.freedesktop.DBus.GetNameOwner", 0, peer).Store(&owner) == nil && owner == sender {
+			return true
+		}
+	}
+
+	return false
+}
+
+var (
+	senderType = reflect.TypeOf(dbus.Sender(""))
+	errorType  = reflect.TypeOf((*dbus.Error)(nil))
+)
+
+// method table of obj where every method first checks the peer; each gets an extra
+// leading dbus.Sender, filled in by godbus like any other, so methods without one are covered too
+func (p *portal) guard(obj any) map[string]any {
+	res := map[string]any{}
+
+	val := reflect.ValueOf(obj)
+
+	for i := 0; i < val.NumMethod(); i++ {
+		name := val.Type().Method(i).Name
+		method := val.Method(i)
+		typ := method.Type()
+
+		if typ.NumOut() == 0 || typ.Out(typ.NumOut()-1) != errorType {
+			continue
+		}
+
+		in := []reflect.Type{senderType}
+		out := make([]reflect.Type, typ.NumOut())
+
+		for j := 0; j < typ.NumIn(); j++ {
+			in = append(in, typ.In(j))
+		}
+
+		for j := range out {
+			out[j] = typ.Out(j)
+		}
+
+		wrapped := reflect.FuncOf(in, out, false)
+
+		res[name] = reflect.MakeFunc(wrapped, func(args []reflect.Value) []reflect.Value {
+			sender := args[0].String()
+
+			if peerAllowed(p.conn, sender) {
+				return method.Call(args[1:])
+			}
+
+			log.Println("deny", name, "to", sender)
+
+			ret := make([]reflect.Value, len(out))
+
+			for j := range out {
+				ret[j] = reflect.Zero(out[j])
+			}
+
+			ret[len(ret)-1] = reflect.ValueOf(dbus.NewError("org.freedesktop.DBus.Error.AccessDenied", []any{
+				sender + " may not call the portal",
+			}))
+
+			return ret
+		}).Interface()
+	}
+
+	return res
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"sync/atomic"
+	"github.com/godbus/dbus/v5"
+)
+
+func TestPeerAllowed(t *testing.T) {
+	var opened atomic.Int32
+
+	b := startPortal(t, func(uri string, opts openOptions) openResult {
+		opened.Add(1)
+
+		return openResult{}
+	})
+
+	sender := b.client.Names()[0]
+	uid := strconv.Itoa(os.Getuid())
+	other := strconv.Itoa(os.Getuid() + 1)
+
+	for _, c := range []struct {
+		peers string
+		want  bool
+	}{
+		{"", true},
+		{uid, true},
+		{other + ", " + uid, true},
+		{sender, true},
+		{other, false},
+		{other + ",:1.999999", false},
+	} {
+		t.Setenv("PORTAL_ALLOWED_PEERS", c.peers)
+
+		if got := peerAllowed(b.portal.conn, sender); got != c.want {
+			t.Errorf("peerAllowed with %q = %v, want %v", c.peers, got, c.want)
+		}
+	}
+
+	// a denied peer never reaches the method
+	t.Setenv("PORTAL_ALLOWED_PEERS", other)
+
+	if _, err := b.openURI("denied", "https://example.org/"); dbusErrorName(err) != "org.freedesktop.DBus.Error.AccessDenied" {
+		t.Errorf("denied uid: %v, want AccessDenied", err)
+	}
+
+	// methods without a sender of their own are guarded too
+	var value dbus.Variant
+
+	if err := b.obj.Call("org.freedesktop.portal.Settings.Read", 0, "org.freedesktop.appearance", "color-scheme").Store(&value); dbusErrorName(err) != "org.freedesktop.DBus.Error.AccessDenied" {
+		t.Errorf("denied uid reading settings: %v, want AccessDenied", err)
+	}
+
+	t.Setenv("PORTAL_ALLOWED_PEERS", uid)
+
+	if code, _ := b.request(t, "org.freedesktop.portal.OpenURI.OpenURI", "", "https://example.org/", kv{"handle_token": dbus.MakeVariant("allowed")}); code != 0 {
+		t.Errorf("allowed uid: code %d", code)
+	}
+
+	if opened.Load() != 1 {
+		t.Errorf("opened %d times, want once for the allowed peer", opened.Load())
+	}
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"log"
+	"time"
+	"sync"
+	"errors"
+	"context"
+	"regexp"
+	"os/exec"
+	"strconv"
+	"strings"
+	"path/filepath"
+	"encoding/json"
+	"github.com/godbus/dbus/v5"
+)
+
+type Screenshot struct {
+	portal *portal
+}
+
+type output struct {
+	name string
+	// WxH+X+Y
+	geom string
+}
+
+func swayOutputs() ([]output, bool) {
+	out, err := exec.Command("swaymsg", "-t", "get_outputs", "-r").Output()
+
+	if err != nil {
+		return nil, false
+	}
+
+	var outputs []struct {
+		Name   string `json:"name"`
+		Active bool   `json:"active"`
+		Rect   struct {
+			X      int `json:"x"`
+			Y      int `json:"y"`
+			Width  int `json:"width"`
+			Height int `json:"height"`
+		} `json:"rect"`
+	}
+
+	if json.Unmarshal(out, &outputs) != nil {
+		return nil, false
+	}
+
+	var res []output
+
+	for _, o := range outputs {
+		if o.Active {
+			res = append(res, output{
+				name: o.Name,
+				geom: fmt.Sprintf("%dx%d+%d+%d", o.Rect.Width, o.Rect.Height, o.Rect.X, o.Rect.Y),
+			})
+		}
+	}
+
+	return res, true
+}
+
+var xrandrGeom = regexp.MustCompile(`^(\d+)/\d+x(\d+)/\d+\+(\d+)\+(\d+)$`)
+
+// " 0: +*eDP-1 1920/344x1080/194+0+0  eDP-1", name is the last field
+func xrandrOutputs() ([]output, bool) {
+	out, err := exec.Command("xrandr", "--listactivemonitors").Output()
+
+	if err != nil {
+		return nil, false
+	}
+
+	var res []output
+
+	for _, line := range strings.Split(string(out), "\n")[1:] {
+		fields := strings.Fields(line)
+
+		if len(fields) < 4 {
+			continue
+		}
+
+		o := output{
+			name: fields[len(fields)-1],
+		}
+
+		if m := xrandrGeom.FindStringSubmatch(fields[2]); m != nil {
+			o.geom = fmt.Sprintf("%sx%s+%s+%s", m[1], m[2], m[3], m[4])
+		}
+
+		res = append(res, o)
+	}
+
+	return res, true
+}
+
+// decided per call, the user may have switched sessions since we started
+func sessionType() string {
+	if session := os.Getenv("XDG_SESSION_TYPE"); session == "wayland" || session == "x11" {
+		return session
+	}
+
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		return "wayland"
+	}
+
+	if os.Getenv("DISPLAY") != "" {
+		return "x11"
+	}
+
+	return "wayland"
+}
+
+// login1's LockedHint for our session, false ok when logind can not tell; asked
+// per call like sessionType, a capture is rare and the answer is never stale
+func sessionLocked() (locked bool, ok bool) {
+	conn, err := dbus.SystemBus()
+
+	if err != nil {
+		log.Println("can not ask logind for the lock state:", err)
+
+		return false, false
+	}
+
+	obj := conn.Object("org.freedesktop.login1", "/org/freedesktop/login1/session/auto")
+
+	hint, err := obj.GetProperty("org.freedesktop.login1.Session.LockedHint")
+
+	if err != nil {
+		log.Println("can not ask logind for the lock state:", err)
+
+		return false, false
+	}
+
+	locked, ok = hint.Value().(bool)
+
+	return locked, ok
+}
+
+var lockedHint = sessionLocked
+
+// PORTAL_SCREENSHOT_WHEN_LOCKED=allow lets captures through a locked session,
+// by default they are denied so the lock screen never ends up in a file; so
+// are they when the lock state is unknown
+func lockDenied() *dbus.Error {
+	if config("SCREENSHOT_WHEN_LOCKED", "deny") == "allow" {
+		return nil
+	}
+
+	locked, ok := lockedHint()
+
+	if !ok {
+		return dbus.NewError("org.freedesktop.DBus.Error.AccessDenied", []any{
+			"can not tell whether the session is locked, PORTAL_SCREENSHOT_WHEN_LOCKED=allow captures anyway",
+		})
+	}
+
+	if !locked {
+		return nil
+	}
+
+	return dbus.NewError("org.freedesktop.DBus.Error.AccessDenied", []any{
+		"session is locked",
+	})
+}
+
+func activeScreenshotBackend() string {
+	if sessionType() == "x11" {
+		return "maim"
+	}
+
+	return "grim"
+}
+
+func outputs(session string) []output {
+	list, tool := swayOutputs, "swaymsg"
+
+	if session == "x11" {
+		list, tool = xrandrOutputs, "xrandr"
+	}
+
+	res, ok := list()
+
+	if !ok {
+		fmtException("can not enumerate %s outputs, need %s", session, tool).throw()
+	}
+
+	return res
+}
+
+var listOutputs = outputs
+
+// output option is either an output name or an index into the output list
+func resolveOutput(session string, opt dbus.Variant) output {
+	outputs := listOutputs(session)
+
+	index := -1
+
+	switch v := opt.Value().(type) {
+	case string:
+		for _, o := range outputs {
+			if o.name == v {
+				return o
+			}
+		}
+
+		if i, err := strconv.Atoi(v); err == nil {
+			index = i
+		}
+	case uint32:
+		index = int(v)
+	case int32:
+		index = int(v)
+	}
+
+	if index >= 0 && index < len(outputs) {
+		return outputs[index]
+	}
+
+	fmtException("unknown output %v", opt.Value()).throw()
+
+	return output{}
+}
+
+func picturesDir() string {
+	if out, err := exec.Command("xdg-user-dir", "PICTURES").Output(); err == nil {
+		if dir := strings.TrimSpace(string(out)); dir != "" {
+			return dir
+		}
+	}
+
+	home, err := homeDir()
+
+	if err != nil {
+		fmtException("can not find pictures dir: %w", err).throw()
+	}
+
+	return filepath.Join(home, "Pictures")
+}
+
+func screenshotPath() string {
+	dir := picturesDir()
+
+	if err := makeDir(dir); err != nil {
+		fmtException("can not create %s: %w", dir, err).throw()
+	}
+
+	return filepath.Join(dir, time.Now().Format("Screenshot-2006-01-02-15-04-05.png"))
+}
+
+type geometry struct {
+	X int32
+	Y int32
+	W uint32
+	H uint32
+}
+
+// slurp (and slop in the same format) print "x,y wxh"
+func parseGeometry(s string) geometry {
+	var g geometry
+
+	if _, err := fmt.Sscanf(strings.TrimSpace(s), "%d,%d %dx%d", &g.X, &g.Y, &g.W, &g.H); err != nil {
+		fmtException("bad region %q: %w", s, err).throw()
+	}
+
+	return g
+}
+
+func selectRegion(ctx context.Context, session string) (geometry, error) {
+	cmd := helperCommand(ctx, "slurp")
+
+	if session == "x11" {
+		cmd = helperCommand(ctx, "slop", "-f", "%x,%y %wx%h")
+	}
+
+	out, err := cmd.Output()
+
+	if err != nil {
+		return geometry{}, err
+	}
+
+	return parseGeometry(string(out)), nil
+}
+
+type shotCall struct {
+	done chan struct{}
+	path string
+	err  error
+	at   time.Time
+}
+
+// identical non interactive captures share one helper run, those in flight and
+// those finished within PORTAL_SCREENSHOT_COALESCE (off by default) get the same file
+type shotCache struct {
+	lock  sync.Mutex
+	calls map[string]*shotCall
+}
+
+var shots = &shotCache{
+	calls: map[string]*shotCall{},
+}
+
+// an unshared capture runs under ctx, a shared one keeps only its deadline, so that
+// a Close of the request that started it does not kill it for those who joined
+func (c *shotCache) get(ctx context.Context, key string, shoot func(context.Context) (string, error)) (string, error) {
+	window, err := time.ParseDuration(config("SCREENSHOT_COALESCE", "0s"))
+
+	if err != nil || window <= 0 {
+		return shoot(ctx)
+	}
+
+	c.lock.Lock()
+
+	if call, ok := c.calls[key]; ok {
+		select {
+		case <-call.done:
+			if call.err == nil && time.Since(call.at) <= window {
+				c.lock.Unlock()
+				log.Println("in Screenshot, reuse", call.path)
+
+				return call.path, nil
+			}
+		default:
+			c.lock.Unlock()
+			<-call.done
+			log.Println("in Screenshot, joined capture", call.path)
+
+			return call.path, call.err
+		}
+	}
+
+	call := &shotCall{
+		done: make(chan struct{}),
+		err:  errors.New("capture aborted"),
+	}
+
+	c.calls[key] = call
+
+	c.lock.Unlock()
+
+	defer func() {
+		call.at = time.Now()
+		close(call.done)
+	}()
+
+	shared := context.Background()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+
+		shared, cancel = context.WithDeadline(shared, deadline)
+		defer cancel()
+	}
+
+	call.path, call.err = shoot(shared)
+
+	return call.path, call.err
+}
+
+func (p *Screenshot) capture(req *request, logger *log.Logger, options kv) {
+	timeout := methodTimeout("Screenshot", options)
+
+	ctx, cancel := context.WithTimeout(req.ctx, timeout)
+	defer cancel()
+
+	session := sessionType()
+	interactive, _ := options["interactive"].Value().(bool)
+	opt, hasOutput := options["output"]
+
+	results := kv{}
+
+	if interactive {
+		g, err := selectRegion(ctx, session)
+
+		if err != nil {
+			code, reason := exitResponse("region selection", err)
+			logger.Println(reason)
+			req.response(code, kv{})
+
+			return
+		}
+
+		results["geometry"] = dbus.MakeVariant(g)
+	}
+
+	var args []string
+
+	switch {
+	case session == "x11" && interactive:
+		g := results["geometry"].Value().(geometry)
+		args = []string{"maim", "-g", fmt.Sprintf("%dx%d+%d+%d", g.W, g.H, g.X, g.Y)}
+	case session == "x11" && hasOutput:
+		args = []string{"maim", "-g", resolveOutput(session, opt).geom}
+	case session == "x11":
+		args = []string{"maim"}
+	case interactive:
+		g := results["geometry"].Value().(geometry)
+		args = []string{"grim", "-g", fmt.Sprintf("%d,%d %dx%d", g.X, g.Y, g.W, g.H)}
+	case hasOutput:
+		args = []string{"grim", "-o", resolveOutput(session, opt).name}
+	default:
+		args = []string{"grim"}
+	}
+
+	req.setBackend(args[0])
+
+	shoot := func(ctx context.Context) (string, error) {
+		path := screenshotPath()
+
+		// screen contents are private, the helper writes into a file that already
+		// has the mode instead of creating one under our umask
+		f, err := openFile(path, os.O_WRONLY, privateFile)
+
+		if err != nil {
+			return "", err
+		}
+
+		f.Close()
+
+		if err := helperCommand(ctx, args[0], append(args[1:], path)...).Run(); err != nil {
+			os.Remove(path)
+
+			return "", err
+		}
+
+		return path, nil
+	}
+
+	var path string
+	var err error
+
+	if interactive {
+		path, err = shoot(ctx)
+	} else {
+		path, err = shots.get(ctx, strings.Join(args, " "), shoot)
+	}
+
+	if err != nil {
+		code, reason := exitResponse(args[0], err)
+
+		// grim and maim never ask anything, their exit 1 is a failure and not a cancel
+		if code == 1 {
+			code, reason = 2, fmt.Sprintf("%s failed with exit code 1", args[0])
+		}
+
+		logger.Println(reason)
+		req.response(code, kv{})
+
+		return
+	}
+
+	results["uri"] = dbus.MakeVariant(fileURI(path))
+
+	req.response(0, results)
+}
+
+func (p *Screenshot) Screenshot(sender dbus.Sender, parent string, options kv) (dbus.ObjectPath, *dbus.Error) {
+	token, id := handleToken(options), correlationID()
+	logger := newLogger("Screenshot", sender, token, id)
+
+	logger.Println("enter", parent, options)
+
+	if err := disabled("Screenshot.Screenshot"); err != nil {
+		return "", err
+	}
+
+	if err := checkOptions("Screenshot.Screenshot", options); err != nil {
+		return "", err
+	}
+
+	if err := lockDenied(); err != nil {
+		logger.Println("deny, session is locked")
+
+		return "", err
+	}
+
+	req, err := newRequest(p.portal, "Screenshot.Screenshot", string(sender), token, id)
+
+	if err != nil {
+		return "", err
+	}
+
+	traceCall(req, options)
+
+	go func() {
+		try(func() {
+			err := try(func() {
+				p.capture(req, logger, options)
+			})
+
+			if err != nil {
+				logger.Println(err.what())
+				req.response(2, kv{})
+			}
+		}).catch(func(exc *Exception) {
+			logger.Println(exc.what())
+		})
+	}()
+
+	return req.path, nil
+}
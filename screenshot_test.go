@@ -0,0 +1,383 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"errors"
+	"context"
+	"strings"
+	"testing"
+	"sync/atomic"
+	"path/filepath"
+	"github.com/godbus/dbus/v5"
+)
+
+// grim recording its arguments and writing the file it is given, PATH and
+// session set up for the wayland path; the log, one line per run
+func fakeGrim(t *testing.T, body string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	log := filepath.Join(dir, "grim.log")
+
+	writeScript(t, dir, "grim", `echo "$@" >> `+log+`
+for last; do :; done
+`+body+`
+echo png > "$last"`)
+
+	t.Setenv("PATH", dir+":/bin:/usr/bin")
+	t.Setenv("XDG_SESSION_TYPE", "wayland")
+	t.Setenv("PORTAL_SCREENSHOT_WHEN_LOCKED", "allow")
+
+	return log
+}
+
+func TestScreenshotOutput(t *testing.T) {
+	log := fakeGrim(t, "")
+
+	listOutputs = func(session string) []output {
+		return []output{{"DP-1", "1920x1080+0+0"}, {"HDMI-A-1", "1280x1024+1920+0"}}
+	}
+
+	// restored after the portal drained its requests, they read it
+	t.Cleanup(func() {
+		listOutputs = outputs
+	})
+
+	b := startPortal(t, nil)
+
+	for _, c := range []struct {
+		output interface{}
+		want   string
+	}{
+		{"HDMI-A-1", "HDMI-A-1"},
+		{uint32(0), "DP-1"},
+		{"1", "HDMI-A-1"},
+	} {
+		os.Remove(log)
+
+		code, results := b.request(t, "org.freedesktop.portal.Screenshot.Screenshot", "", kv{"output": dbus.MakeVariant(c.output)})
+
+		if code != 0 {
+			t.Errorf("output %v: code %d", c.output, code)
+
+			continue
+		}
+
+		data, _ := os.ReadFile(log)
+
+		if uri, _ := results["uri"].Value().(string); uri == "" || !strings.HasPrefix(string(data), "-o "+c.want+" ") {
+			t.Errorf("output %v: grim ran with %q, uri %q, want -o %s", c.output, data, uri, c.want)
+		}
+	}
+
+	for _, unknown := range []interface{}{"VGA-9", uint32(2), "-1"} {
+		if code, _ := b.request(t, "org.freedesktop.portal.Screenshot.Screenshot", "", kv{"output": dbus.MakeVariant(unknown)}); code != 2 {
+			t.Errorf("unknown output %v answered %d, want 2", unknown, code)
+		}
+	}
+}
+
+func TestScreenshotSessionSwitch(t *testing.T) {
+	grim := fakeGrim(t, "")
+	maim := filepath.Join(filepath.Dir(grim), "maim.log")
+
+	writeScript(t, filepath.Dir(grim), "maim", `echo "$@" >> `+maim+`
+for last; do :; done
+echo png > "$last"`)
+
+	b := startPortal(t, nil)
+
+	runs := func(log string) int {
+		data, _ := os.ReadFile(log)
+
+		return strings.Count(string(data), "\n")
+	}
+
+	for i, c := range []struct {
+		session string
+		want    string
+		grim    int
+		maim    int
+	}{
+		{"wayland", "grim", 1, 0},
+		{"x11", "maim", 1, 1},
+		{"wayland", "grim", 2, 1},
+	} {
+		t.Setenv("XDG_SESSION_TYPE", c.session)
+
+		if got := activeScreenshotBackend(); got != c.want {
+			t.Errorf("%s session: backend %s, want %s", c.session, got, c.want)
+		}
+
+		if code, _ := b.request(t, "org.freedesktop.portal.Screenshot.Screenshot", "", kv{"handle_token": dbus.MakeVariant(fmt.Sprintf("shot%d", i))}); code != 0 {
+			t.Errorf("%s session: code %d", c.session, code)
+		}
+
+		if runs(grim) != c.grim || runs(maim) != c.maim {
+			t.Errorf("%s session: grim ran %d times, maim %d, want %d and %d", c.session, runs(grim), runs(maim), c.grim, c.maim)
+		}
+	}
+
+	// no session type, the display variables decide
+	t.Setenv("XDG_SESSION_TYPE", "")
+	t.Setenv("WAYLAND_DISPLAY", "")
+	t.Setenv("DISPLAY", ":0")
+
+	if got := sessionType(); got != "x11" {
+		t.Errorf("DISPLAY only: %s, want x11", got)
+	}
+
+	t.Setenv("WAYLAND_DISPLAY", "wayland-0")
+
+	if got := sessionType(); got != "wayland" {
+		t.Errorf("WAYLAND_DISPLAY set: %s, want wayland", got)
+	}
+}
+
+func TestParseGeometry(t *testing.T) {
+	if g := parseGeometry("10,-20 300x400\n"); g != (geometry{10, -20, 300, 400}) {
+		t.Errorf("parseGeometry = %+v", g)
+	}
+
+	for _, bad := range []string{"", "10,20", "a,b cxd"} {
+		if exc := try(func() { parseGeometry(bad) }); exc == nil {
+			t.Errorf("parseGeometry(%q) did not fail", bad)
+		}
+	}
+}
+
+func TestScreenshotGeometry(t *testing.T) {
+	log := fakeGrim(t, "")
+
+	writeScript(t, filepath.Dir(log), "slurp", "echo '10,20 300x400'")
+
+	b := startPortal(t, nil)
+
+	code, results := b.request(t, "org.freedesktop.portal.Screenshot.Screenshot", "", kv{"interactive": dbus.MakeVariant(true)})
+
+	if code != 0 {
+		t.Fatalf("code %d", code)
+	}
+
+	var g geometry
+
+	if err := results["geometry"].Store(&g); err != nil || g != (geometry{10, 20, 300, 400}) {
+		t.Errorf("geometry %v, %v", results["geometry"], err)
+	}
+
+	if data, _ := os.ReadFile(log); !strings.HasPrefix(string(data), "-g 10,20 300x400 ") {
+		t.Errorf("grim ran with %q", data)
+	}
+}
+
+func TestShotCache(t *testing.T) {
+	c := &shotCache{
+		calls: map[string]*shotCall{},
+	}
+
+	shots := 0
+
+	shoot := func(context.Context) (string, error) {
+		shots++
+
+		return "/tmp/shot.png", nil
+	}
+
+	t.Setenv("PORTAL_SCREENSHOT_COALESCE", "0s")
+
+	c.get(context.Background(), "full", shoot)
+	c.get(context.Background(), "full", shoot)
+
+	if shots != 2 {
+		t.Errorf("%d shots with coalescing off, want 2", shots)
+	}
+
+	t.Setenv("PORTAL_SCREENSHOT_COALESCE", "1m")
+
+	shots = 0
+
+	for i := 0; i < 3; i++ {
+		if path, err := c.get(context.Background(), "full", shoot); err != nil || path != "/tmp/shot.png" {
+			t.Errorf("get = %q, %v", path, err)
+		}
+	}
+
+	c.get(context.Background(), "region", shoot)
+
+	if shots != 2 {
+		t.Errorf("%d shots for two keys, want 2", shots)
+	}
+
+	// a failed capture is never handed out again
+	failed := 0
+
+	fail := func(context.Context) (string, error) {
+		failed++
+
+		return "", errors.New("no output")
+	}
+
+	c.get(context.Background(), "broken", fail)
+
+	if _, err := c.get(context.Background(), "broken", fail); err == nil || failed != 2 {
+		t.Errorf("failed capture reused: %v after %d tries", err, failed)
+	}
+}
+
+func TestShotCacheContext(t *testing.T) {
+	c := &shotCache{
+		calls: map[string]*shotCall{},
+	}
+
+	deadline := time.Now().Add(time.Minute)
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	cancel()
+
+	var done error
+	var until time.Time
+
+	shoot := func(ctx context.Context) (string, error) {
+		done = ctx.Err()
+		until, _ = ctx.Deadline()
+
+		return "/tmp/shot.png", nil
+	}
+
+	// not shared, a Close of the request stops the helper
+	t.Setenv("PORTAL_SCREENSHOT_COALESCE", "0s")
+
+	c.get(ctx, "full", shoot)
+
+	if done == nil {
+		t.Error("unshared capture does not run under the request context")
+	}
+
+	t.Setenv("PORTAL_SCREENSHOT_COALESCE", "1m")
+
+	c.get(ctx, "full", shoot)
+
+	if done != nil {
+		t.Errorf("shared capture cancelled with the request: %v", done)
+	}
+
+	if !until.Equal(deadline) {
+		t.Errorf("shared capture deadline %v, want %v", until, deadline)
+	}
+}
+
+func TestSharedCaptureOutlivesClose(t *testing.T) {
+	log := fakeGrim(t, "sleep 1")
+
+	t.Setenv("PORTAL_SCREENSHOT_COALESCE", "1m")
+
+	shots = &shotCache{
+		calls: map[string]*shotCall{},
+	}
+
+	t.Cleanup(func() {
+		shots = &shotCache{
+			calls: map[string]*shotCall{},
+		}
+	})
+
+	b := startPortal(t, nil)
+
+	call := func(token string) dbus.ObjectPath {
+		t.Helper()
+
+		var handle dbus.ObjectPath
+
+		if err := b.obj.Call("org.freedesktop.portal.Screenshot.Screenshot", 0, "", kv{"handle_token": dbus.MakeVariant(token)}).Store(&handle); err != nil {
+			t.Fatal(err)
+		}
+
+		return handle
+	}
+
+	first := call("first")
+
+	// grim is running for the first request
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(log); err == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("grim never started")
+		}
+	}
+
+	second := call("second")
+
+	if err := b.client.Object("org.freedesktop.portal.Desktop", first).Call("org.freedesktop.portal.Request.Close", 0).Err; err != nil {
+		t.Fatal(err)
+	}
+
+	code, results, ok := b.response(t, second, 10*time.Second)
+
+	if uri, _ := results["uri"].Value().(string); !ok || code != 0 || uri == "" {
+		t.Fatalf("joined capture answered %d %v, %v after the first request closed", code, results, ok)
+	}
+
+	if data, _ := os.ReadFile(log); strings.Count(string(data), "\n") != 1 {
+		t.Errorf("grim ran %d times, want once for both", strings.Count(string(data), "\n"))
+	}
+}
+
+func TestScreenshotLocked(t *testing.T) {
+	fakeGrim(t, "")
+
+	t.Setenv("PORTAL_SCREENSHOT_WHEN_LOCKED", "deny")
+
+	var locked, unknown atomic.Bool
+
+	lockedHint = func() (bool, bool) {
+		return locked.Load(), !unknown.Load()
+	}
+
+	// restored after the portal drained its requests, they read it
+	t.Cleanup(func() {
+		lockedHint = sessionLocked
+	})
+
+	b := startPortal(t, nil)
+
+	if code, _ := b.request(t, "org.freedesktop.portal.Screenshot.Screenshot", "", kv{"handle_token": dbus.MakeVariant("unlocked")}); code != 0 {
+		t.Errorf("unlocked session: code %d, want 0", code)
+	}
+
+	denied := func(token string) bool {
+		t.Helper()
+
+		var handle dbus.ObjectPath
+
+		err := b.obj.Call("org.freedesktop.portal.Screenshot.Screenshot", 0, "", kv{"handle_token": dbus.MakeVariant(token)}).Store(&handle)
+
+		return dbusErrorName(err) == "org.freedesktop.DBus.Error.AccessDenied"
+	}
+
+	locked.Store(true)
+
+	if !denied("locked") {
+		t.Error("locked session: want AccessDenied")
+	}
+
+	// logind can not tell, as good as locked
+	locked.Store(false)
+	unknown.Store(true)
+
+	if !denied("unknown") {
+		t.Error("unknown lock state: want AccessDenied")
+	}
+
+	locked.Store(true)
+
+	t.Setenv("PORTAL_SCREENSHOT_WHEN_LOCKED", "allow")
+
+	if code, _ := b.request(t, "org.freedesktop.portal.Screenshot.Screenshot", "", kv{"handle_token": dbus.MakeVariant("allowed")}); code != 0 {
+		t.Errorf("locked session with captures allowed: code %d, want 0", code)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"bufio"
+	"os/exec"
+	"strings"
+	"github.com/godbus/dbus/v5"
+)
+
+// --selftest: serve on a private bus and round-trip real calls through it
+
+func privateBus() (string, func()) {
+	cmd := exec.Command("dbus-daemon", "--session", "--nofork", "--print-address=1")
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.StdoutPipe()
+
+	if err != nil {
+		fmtException("can not start dbus-daemon: %w", err).throw()
+	}
+
+	if err := cmd.Start(); err != nil {
+		fmtException("can not start dbus-daemon: %w", err).throw()
+	}
+
+	stop := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+
+	addr, err := bufio.NewReader(out).ReadString('\n')
+
+	if err != nil {
+		stop()
+		fmtException("can not read dbus-daemon address: %w", err).throw()
+	}
+
+	return strings.TrimSpace(addr), stop
+}
+
+func connect(addr string) *dbus.Conn {
+	conn, err := dbus.Connect(addr)
+
+	if err != nil {
+		fmtException("can not connect %s: %w", addr, err).withCode(exitNoBus).throw()
+	}
+
+	return conn
+}
+
+func selftestStep(name string, cb func()) {
+	try(cb).catch(func(exc *Exception) {
+		fmtException("selftest %s: %v", name, exc.what()).throw()
+	})
+
+	fmt.Println("selftest", name, "ok")
+}
+
+func selftest() {
+	addr, stop := privateBus()
+	defer stop()
+
+	server := connect(addr)
+	defer server.Close()
+
+	opened := make(chan string, 1)
+
+	defer serve(server, func(uri string, opts openOptions) openResult {
+		opened <- uri
+
+		return openResult{handler: "selftest"}
+	}, dbus.NameFlagDoNotQueue)()
+
+	client := connect(addr)
+	defer client.Close()
+
+	obj := client.Object("org.freedesktop.portal.Desktop", desktopPath)
+
+	selftestStep("ReadOne", func() {
+		var res dbus.Variant
+
+		err := obj.Call("org.freedesktop.portal.Settings.ReadOne", 0, "org.freedesktop.appearance", "color-scheme").Store(&res)
+
+		if err != nil {
+			fmtException("call failed: %w", err).throw()
+		}
+
+		if val, ok := res.Value().(uint32); !ok || val > 2 {
+			fmtException("bad color-scheme %v", res).throw()
+		}
+	})
+
+	selftestStep("Debug", func() {
+		pid, err := obj.GetProperty(extNamespace + ".Debug.Pid")
+
+		if err != nil {
+			fmtException("can not get Pid: %w", err).throw()
+		}
+
+		if val, _ := pid.Value().(uint32); val != uint32(os.Getpid()) {
+			fmtException("Pid %v, want %d", pid, os.Getpid()).throw()
+		}
+	})
+
+	selftestStep("OpenURI", func() {
+		err := client.AddMatchSignal(dbus.WithMatchInterface("org.freedesktop.portal.Request"), dbus.WithMatchMember("Response"))
+
+		if err != nil {
+			fmtException("can not subscribe: %w", err).throw()
+		}
+
+		signals := make(chan *dbus.Signal, 4)
+		client.Signal(signals)
+
+		var handle dbus.ObjectPath
+
+		options := kv{
+			"handle_token": dbus.MakeVariant("selftest"),
+		}
+
+		err = obj.Call("org.freedesktop.portal.OpenURI.OpenURI", 0, "", "about:blank", options).Store(&handle)
+
+		if err != nil {
+			fmtException("call failed: %w", err).throw()
+		}
+
+		timeout := time.After(5 * time.Second)
+
+		for {
+			select {
+			case sig := <-signals:
+				if sig.Path != handle {
+					continue
+				}
+
+				if code, _ := sig.Body[0].(uint32); code != 0 {
+					fmtException("response code %d", code).throw()
+				}
+
+				if uri := <-opened; uri != "about:blank" {
+					fmtException("opened %s instead of about:blank", uri).throw()
+				}
+
+				return
+			case <-timeout:
+				fmtException("no response on %s", handle).throw()
+			}
+		}
+	})
+
+	fmt.Println("selftest passed")
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"log"
+	"errors"
+	"strings"
+	"syscall"
+	"sync/atomic"
+	"path/filepath"
+)
+
+// small persistent per-app state, one file per app under $XDG_STATE_HOME/portal/<kind>
+
+func stateHome() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return dir
+	}
+
+	home, err := homeDir()
+
+	if err != nil {
+		fmtException("can not find state dir: %w", err).throw()
+	}
+
+	return filepath.Join(home, ".local", "state")
+}
+
+func configHome() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return dir
+	}
+
+	home, err := homeDir()
+
+	if err != nil {
+		fmtException("can not find config dir: %w", err).throw()
+	}
+
+	return filepath.Join(home, ".config")
+}
+
+// $XDG_DATA_HOME, then $XDG_DATA_DIRS, most important first
+func dataDirs() []string {
+	home, _ := homeDir()
+
+	dataHome := os.Getenv("XDG_DATA_HOME")
+
+	if dataHome == "" {
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+
+	dirs := os.Getenv("XDG_DATA_DIRS")
+
+	if dirs == "" {
+		dirs = "/usr/local/share:/usr/share"
+	}
+
+	return append([]string{dataHome}, filepath.SplitList(dirs)...)
+}
+
+type stateStore struct {
+	kind string
+	// set once the state dir turned out read only, cleared by retry
+	readOnly atomic.Bool
+}
+
+func (s *stateStore) path(app string) string {
+	// app ids are reverse dns, keep anything else out of the path
+	app = strings.Map(func(r rune) rune {
+		if r == '/' || r == 0 {
+			return '_'
+		}
+
+		return r
+	}, app)
+
+	if app == "." || app == ".." {
+		app = "_"
+	}
+
+	return filepath.Join(stateHome(), "portal", s.kind, app)
+}
+
+// unidentified callers get no state
+func (s *stateStore) get(app string) (res string) {
+	if app == "" {
+		return ""
+	}
+
+	try(func() {
+		data, err := os.ReadFile(s.path(app))
+
+		if err == nil {
+			res = string(data)
+		}
+	}).catch(func(exc *Exception) {
+		log.Println("in stateStore.get", exc.what())
+	})
+
+	return res
+}
+
+// how set writes, swapped out by tests to fake a read only state dir
+var writeState = writeFile
+
+// state is a convenience, a read only or missing state dir (kiosk setups with an
+// immutable home) must not fail the request that wanted to remember something;
+// only that stops saving for everyone, a failure for one app costs just that write
+func (s *stateStore) set(app string, val string) {
+	if app == "" || s.readOnly.Load() {
+		return
+	}
+
+	try(func() {
+		path := s.path(app)
+
+		err := writeState(path, []byte(val), privateFile)
+
+		if errors.Is(err, syscall.EROFS) || errors.Is(err, syscall.EACCES) {
+			s.readOnly.Store(true)
+			log.Printf("%s state dir is not writable, not persisting it until SIGHUP: %v", s.kind, err)
+		} else if err != nil {
+			log.Printf("can not save %s state for %s: %v", s.kind, app, err)
+		}
+	}).catch(func(exc *Exception) {
+		s.readOnly.Store(true)
+		log.Printf("can not save %s state, not persisting it until SIGHUP: %s", s.kind, exc.what())
+	})
+}
+
+// on SIGHUP and reprobe, the dir may have been fixed or remounted since
+func (s *stateStore) retry() {
+	if s.readOnly.Swap(false) {
+		log.Printf("retry saving %s state", s.kind)
+	}
+}
+
+var lastFolders = &stateStore{
+	kind: "last-folder",
+}
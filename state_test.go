@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"sync/atomic"
+	"path/filepath"
+	"github.com/godbus/dbus/v5"
+)
+
+func TestStateStore(t *testing.T) {
+	dir := isolate(t)
+
+	s := &stateStore{kind: "test"}
+
+	s.set("org.example.App", "/home/u/Pictures")
+	s.set("", "/nowhere")
+
+	if got := s.get("org.example.App"); got != "/home/u/Pictures" {
+		t.Errorf("get = %q after set", got)
+	}
+
+	if got := s.get(""); got != "" {
+		t.Errorf("unidentified caller got %q", got)
+	}
+
+	// app ids never leave the store's dir
+	s.set("../../escape", "x")
+
+	if _, err := os.Stat(filepath.Join(dir, "escape")); err == nil {
+		t.Error("an app id with / escaped the state dir")
+	}
+
+	if got := s.get("../../escape"); got != "x" {
+		t.Errorf("mangled app id read back %q", got)
+	}
+
+	st, err := os.Stat(s.path("org.example.App"))
+
+	if err != nil || st.Mode().Perm() != privateFile {
+		t.Errorf("state file %v, %v, want mode %v", st.Mode(), err, privateFile)
+	}
+}
+
+func TestStartFolder(t *testing.T) {
+	dir := isolate(t)
+
+	pictures := filepath.Join(dir, "Pictures")
+
+	if err := os.Mkdir(pictures, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	app := "org.example.App"
+
+	if got := startFolder(kv{}, app); got != dir {
+		t.Errorf("nothing remembered: %s, want home", got)
+	}
+
+	lastFolders.set(app, pictures)
+
+	if got := startFolder(kv{}, app); got != pictures {
+		t.Errorf("remembered: %s, want %s", got, pictures)
+	}
+
+	if got := startFolder(kv{}, "org.example.Other"); got != dir {
+		t.Errorf("another app: %s, want home", got)
+	}
+
+	// current_folder is NUL terminated ay
+	if got := startFolder(kv{"current_folder": dbus.MakeVariant([]byte("/tmp\x00"))}, app); got != "/tmp" {
+		t.Errorf("current_folder: %s, want /tmp", got)
+	}
+
+	os.Remove(pictures)
+
+	if got := startFolder(kv{}, app); got != dir {
+		t.Errorf("remembered folder gone: %s, want home", got)
+	}
+}
+
+func TestStateReadOnly(t *testing.T) {
+	var readOnly atomic.Bool
+	var writes atomic.Int32
+
+	readOnly.Store(true)
+
+	saved := writeState
+
+	// the state dir as a read only mount has it, root included
+	writeState = func(path string, data []byte, mode os.FileMode) error {
+		writes.Add(1)
+
+		if readOnly.Load() {
+			return &os.PathError{Op: "open", Path: path, Err: syscall.EROFS}
+		}
+
+		return saved(path, data, mode)
+	}
+
+	// restored after the portal drained its requests, they write through it
+	t.Cleanup(func() {
+		writeState = saved
+	})
+
+	b := startPortal(t, nil)
+
+	t.Cleanup(lastFolders.retry)
+
+	pick := filepath.Join(os.Getenv("HOME"), "pick.txt")
+
+	if err := os.WriteFile(pick, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PORTAL_FILECHOOSER_AUTOANSWER", pick)
+
+	state := filepath.Join(os.Getenv("XDG_STATE_HOME"), "portal", "last-folder")
+
+	open := func(token string) {
+		t.Helper()
+
+		code, results := b.request(t, "org.freedesktop.portal.FileChooser.OpenFile", "", "title", kv{"handle_token": dbus.MakeVariant(token)})
+
+		if uris, _ := results["uris"].Value().([]string); code != 0 || len(uris) != 1 {
+			t.Fatalf("OpenFile answered %d %v", code, results)
+		}
+	}
+
+	open("readonly")
+
+	if !lastFolders.readOnly.Load() {
+		t.Error("read only state dir not noticed")
+	}
+
+	// known read only, not tried again until retry
+	open("again")
+
+	if n := writes.Load(); n != 1 {
+		t.Errorf("%d writes to a read only state dir, want 1", n)
+	}
+
+	readOnly.Store(false)
+	lastFolders.retry()
+
+	if lastFolders.readOnly.Load() {
+		t.Error("retry left the store read only")
+	}
+
+	open("writable")
+
+	if saved, _ := filepath.Glob(filepath.Join(state, "[!.]*")); len(saved) != 1 {
+		t.Errorf("%d last folders saved once writable, want 1", len(saved))
+	}
+}
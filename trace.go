@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"log"
+	"sync"
+	"time"
+	"strings"
+	"encoding/json"
+	"github.com/godbus/dbus/v5"
+)
+
+// PORTAL_RECORD=<file> appends a json line per call and per Response, for
+// reproducing user reports; writes are async and dropped rather than block a call
+
+type traceRecord struct {
+	Time    time.Time         `json:"time"`
+	Event   string            `json:"event"`
+	Path    dbus.ObjectPath   `json:"path"`
+	ID      string            `json:"id"`
+	Method  string            `json:"method,omitempty"`
+	Sender  string            `json:"sender,omitempty"`
+	Args    []string          `json:"args,omitempty"`
+	Options map[string]string `json:"options,omitempty"`
+	Code    *uint32           `json:"code,omitempty"`
+	Results map[string]string `json:"results,omitempty"`
+	Backend string            `json:"backend,omitempty"`
+}
+
+var (
+	traceOnce sync.Once
+	traces    chan *traceRecord
+)
+
+func traceWriter(path string) {
+	f, err := openFile(path, os.O_WRONLY|os.O_APPEND, privateFile)
+
+	if err != nil {
+		log.Println("can not open PORTAL_RECORD, not recording:", err)
+
+		for range traces {
+		}
+
+		return
+	}
+
+	enc := json.NewEncoder(f)
+	enc.SetEscapeHTML(false)
+
+	for rec := range traces {
+		if err := enc.Encode(rec); err != nil {
+			log.Println("can not record:", err)
+		}
+	}
+}
+
+func record(rec *traceRecord) {
+	path := config("RECORD", "")
+
+	if path == "" {
+		return
+	}
+
+	traceOnce.Do(func() {
+		traces = make(chan *traceRecord, 1024)
+
+		go traceWriter(path)
+	})
+
+	rec.Time = time.Now()
+
+	select {
+	case traces <- rec:
+	default:
+		log.Println("record queue full, drop", rec.Event, rec.Path)
+	}
+}
+
+// activation tokens and the like stay out of the trace
+func redacted(key string) bool {
+	key = strings.ToLower(key)
+
+	if key == "handle_token" {
+		return false
+	}
+
+	return strings.Contains(key, "token") || strings.Contains(key, "secret") || strings.Contains(key, "password")
+}
+
+func traceValues(vals kv) map[string]string {
+	res := map[string]string{}
+
+	for key, val := range vals {
+		if redacted(key) {
+			res[key] = "<redacted>"
+		} else {
+			res[key] = val.String()
+		}
+	}
+
+	return res
+}
+
+// args are the positional arguments worth keeping, uri, title and such
+func traceCall(req *request, options kv, args ...string) {
+	record(&traceRecord{
+		Event:   "call",
+		Path:    req.path,
+		ID:      req.id,
+		Method:  req.method,
+		Sender:  req.sender,
+		Args:    args,
+		Options: traceValues(options),
+	})
+}
+
+func traceResponse(req *request, code uint32, results kv, backend string) {
+	record(&traceRecord{
+		Event:   "response",
+		Path:    req.path,
+		ID:      req.id,
+		Code:    &code,
+		Results: traceValues(results),
+		Backend: backend,
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+	"strings"
+	"testing"
+	"encoding/json"
+	"github.com/godbus/dbus/v5"
+)
+
+// the recorder opens PORTAL_RECORD once per process, every test records into one file
+var traceFile struct {
+	once sync.Once
+	path string
+	err  error
+}
+
+func recordTo(t *testing.T) string {
+	t.Helper()
+
+	traceFile.once.Do(func() {
+		var f *os.File
+
+		if f, traceFile.err = os.CreateTemp("", "portal-trace-*.jsonl"); traceFile.err == nil {
+			traceFile.path = f.Name()
+			f.Close()
+		}
+	})
+
+	if traceFile.err != nil {
+		t.Fatal(traceFile.err)
+	}
+
+	t.Setenv("PORTAL_RECORD", traceFile.path)
+
+	return traceFile.path
+}
+
+// the record of event for the request at path, the writer is async
+func traced(t *testing.T, file string, path dbus.ObjectPath, event string) *traceRecord {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		data, _ := os.ReadFile(file)
+
+		for _, line := range strings.Split(string(data), "\n") {
+			var rec traceRecord
+
+			if json.Unmarshal([]byte(line), &rec) == nil && rec.Path == path && rec.Event == event {
+				return &rec
+			}
+		}
+	}
+
+	t.Fatalf("no %s recorded for %s", event, path)
+
+	return nil
+}
+
+func TestRecord(t *testing.T) {
+	b := startPortal(t, func(uri string, opts openOptions) openResult {
+		return openResult{handler: "test", backend: "xdg-open"}
+	})
+
+	file := recordTo(t)
+
+	var handle dbus.ObjectPath
+
+	options := kv{
+		"handle_token":     dbus.MakeVariant("traced"),
+		"activation_token": dbus.MakeVariant("deadbeef"),
+	}
+
+	if err := b.obj.Call("org.freedesktop.portal.OpenURI.OpenURI", 0, "", "https://example.org/", options).Store(&handle); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, _, ok := b.response(t, handle, 5*time.Second); !ok || code != 0 {
+		t.Fatalf("answered %d, %v", code, ok)
+	}
+
+	call := traced(t, file, handle, "call")
+
+	if call.Method != "OpenURI.OpenURI" || call.Sender != b.client.Names()[0] || len(call.Args) != 1 || call.Args[0] != "https://example.org/" {
+		t.Errorf("call recorded as %+v", call)
+	}
+
+	if call.Options["activation_token"] != "<redacted>" || !strings.Contains(call.Options["handle_token"], "traced") {
+		t.Errorf("options recorded as %v, want the activation token redacted", call.Options)
+	}
+
+	res := traced(t, file, handle, "response")
+
+	if res.Code == nil || *res.Code != 0 || res.ID != call.ID || res.ID == "" {
+		t.Errorf("response recorded as %+v, want code 0 and the id of the call %q", res, call.ID)
+	}
+
+	if res.Backend != "xdg-open" {
+		t.Errorf("response recorded backend %q, want xdg-open", res.Backend)
+	}
+}
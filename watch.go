@@ -0,0 +1,256 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"strings"
+	"github.com/godbus/dbus/v5"
+)
+
+// refcounted signal subscriptions, one bus match rule per distinct rule
+
+const busName = "org.freedesktop.DBus"
+
+type matchRule struct {
+	// the only peer the signal is taken from, any when empty; broadcasts reach
+	// every connection, so anybody else saying the same thing is not listened to
+	sender string
+	iface  string
+	member string
+	path   dbus.ObjectPath
+}
+
+func (r matchRule) options() []dbus.MatchOption {
+	res := []dbus.MatchOption{
+		dbus.WithMatchInterface(r.iface),
+		dbus.WithMatchMember(r.member),
+		dbus.WithMatchPathNamespace(r.path),
+	}
+
+	if r.sender != "" {
+		res = append(res, dbus.WithMatchSender(r.sender))
+	}
+
+	return res
+}
+
+// signals carry the unique name of who sent them, owner is that of r.sender
+func (r matchRule) matches(sig *dbus.Signal, owner string) bool {
+	if sig.Name != r.iface+"."+r.member {
+		return false
+	}
+
+	if r.sender != "" && (owner == "" || sig.Sender != owner) {
+		return false
+	}
+
+	return sig.Path == r.path || strings.HasPrefix(string(sig.Path), string(r.path)+"/")
+}
+
+type subscription struct {
+	rule matchRule
+	cb   func(*dbus.Signal)
+}
+
+type watchers struct {
+	conn *dbus.Conn
+	lock sync.Mutex
+	refs map[matchRule]int
+	subs map[int]*subscription
+	next int
+	// unique name owning each well known sender of a watched rule, "" while
+	// nobody does; kept current by the bus's NameOwnerChanged
+	owners map[string]string
+	// watched rules per sender, the owner is tracked while there are any
+	senders map[string]int
+}
+
+func newWatchers(conn *dbus.Conn) *watchers {
+	w := &watchers{
+		conn:    conn,
+		refs:    map[matchRule]int{},
+		subs:    map[int]*subscription{},
+		owners:  map[string]string{},
+		senders: map[string]int{},
+	}
+
+	ch := make(chan *dbus.Signal, 16)
+
+	conn.Signal(ch)
+
+	go func() {
+		for sig := range ch {
+			w.dispatch(sig)
+		}
+	}()
+
+	return w
+}
+
+// the bus speaks for itself, unique names are their own owners
+func (w *watchers) owner(name string) string {
+	if name == "" || name == busName || strings.HasPrefix(name, ":") {
+		return name
+	}
+
+	return w.owners[name]
+}
+
+func ownerRule(name string) []dbus.MatchOption {
+	return []dbus.MatchOption{
+		dbus.WithMatchSender(busName),
+		dbus.WithMatchInterface(busName),
+		dbus.WithMatchMember("NameOwnerChanged"),
+		dbus.WithMatchObjectPath("/org/freedesktop/DBus"),
+		dbus.WithMatchArg(0, name),
+	}
+}
+
+// start following the owner of a rule's sender, w.lock held
+func (w *watchers) track(name string) {
+	if w.senders[name]++; w.senders[name] > 1 || w.owner(name) == name {
+		return
+	}
+
+	if err := w.conn.AddMatchSignal(ownerRule(name)...); err != nil {
+		log.Println("can not follow the owner of", name, err)
+	}
+
+	var owner string
+
+	// not running yet is fine, NameOwnerChanged tells when it starts
+	w.conn.BusObject().Call(busName+".GetNameOwner", 0, name).Store(&owner)
+
+	w.owners[name] = owner
+}
+
+func (w *watchers) untrack(name string) {
+	if w.senders[name]--; w.senders[name] > 0 {
+		return
+	}
+
+	delete(w.senders, name)
+
+	if _, tracked := w.owners[name]; !tracked {
+		return
+	}
+
+	delete(w.owners, name)
+
+	if err := w.conn.RemoveMatchSignal(ownerRule(name)...); err != nil {
+		log.Println("can not remove match rule", err)
+	}
+}
+
+func (w *watchers) dispatch(sig *dbus.Signal) {
+	var cbs []func(*dbus.Signal)
+
+	w.lock.Lock()
+
+	if sig.Sender == busName && sig.Name == busName+".NameOwnerChanged" && len(sig.Body) == 3 {
+		name, _ := sig.Body[0].(string)
+		owner, _ := sig.Body[2].(string)
+
+		if _, tracked := w.owners[name]; tracked {
+			w.owners[name] = owner
+		}
+	}
+
+	for _, sub := range w.subs {
+		if sub.rule.matches(sig, w.owner(sub.rule.sender)) {
+			cbs = append(cbs, sub.cb)
+		}
+	}
+
+	w.lock.Unlock()
+
+	for _, cb := range cbs {
+		try(func() {
+			cb(sig)
+		}).catch(func(exc *Exception) {
+			log.Println("in signal handler", exc.what())
+		})
+	}
+}
+
+// returned func drops the subscription, match rule goes away with the last one
+func (w *watchers) watch(rule matchRule, cb func(*dbus.Signal)) func() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.refs[rule] == 0 {
+		if err := w.conn.AddMatchSignal(rule.options()...); err != nil {
+			fmtException("can not add match rule: %w", err).throw()
+		}
+
+		w.track(rule.sender)
+	}
+
+	w.refs[rule]++
+	w.next++
+
+	id := w.next
+
+	w.subs[id] = &subscription{
+		rule: rule,
+		cb:   cb,
+	}
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			w.unwatch(id)
+		})
+	}
+}
+
+func (w *watchers) unwatch(id int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	rule := w.subs[id].rule
+
+	delete(w.subs, id)
+
+	if w.refs[rule]--; w.refs[rule] > 0 {
+		return
+	}
+
+	delete(w.refs, rule)
+
+	if err := w.conn.RemoveMatchSignal(rule.options()...); err != nil {
+		log.Println("can not remove match rule", err)
+	}
+
+	w.untrack(rule.sender)
+}
+
+var dconfNotify = matchRule{
+	sender: "ca.desrt.dconf",
+	iface:  "ca.desrt.dconf.Writer",
+	member: "Notify",
+	path:   "/ca/desrt/dconf/Writer",
+}
+
+// dconf Notify carries (prefix, relative changes, tag)
+func dconfKeys(sig *dbus.Signal) []string {
+	if len(sig.Body) < 2 {
+		return nil
+	}
+
+	prefix, _ := sig.Body[0].(string)
+	changes, _ := sig.Body[1].([]string)
+
+	if len(changes) == 0 {
+		return []string{prefix}
+	}
+
+	var res []string
+
+	for _, change := range changes {
+		res = append(res, prefix+change)
+	}
+
+	return res
+}
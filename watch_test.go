@@ -0,0 +1,231 @@
+package main
+
+import (
+	"os"
+	"time"
+	"strings"
+	"testing"
+	"github.com/godbus/dbus/v5"
+)
+
+func ownName(t *testing.T, conn *dbus.Conn, name string) {
+	t.Helper()
+
+	reply, err := conn.RequestName(name, dbus.NameFlagDoNotQueue)
+
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("can not own %s: %v %v", name, reply, err)
+	}
+}
+
+// the next signal a watch callback got, nil when none came within wait
+func nextSignal(got chan *dbus.Signal, wait time.Duration) *dbus.Signal {
+	select {
+	case sig := <-got:
+		return sig
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+// a signal sent to dest alone, which the bus delivers whatever match rules say
+func sendSignal(t *testing.T, conn *dbus.Conn, dest string, path dbus.ObjectPath, name string, values ...interface{}) {
+	t.Helper()
+
+	iface, member := name[:strings.LastIndex(name, ".")], name[strings.LastIndex(name, ".")+1:]
+
+	msg := &dbus.Message{
+		Type: dbus.TypeSignal,
+		Headers: map[dbus.HeaderField]dbus.Variant{
+			dbus.FieldDestination: dbus.MakeVariant(dest),
+			dbus.FieldPath:        dbus.MakeVariant(path),
+			dbus.FieldInterface:   dbus.MakeVariant(iface),
+			dbus.FieldMember:      dbus.MakeVariant(member),
+		},
+		Body: values,
+	}
+
+	if len(values) > 0 {
+		msg.Headers[dbus.FieldSignature] = dbus.MakeVariant(dbus.SignatureOf(values...))
+	}
+
+	if call := conn.Send(msg, nil); call.Err != nil {
+		t.Fatal(call.Err)
+	}
+}
+
+func notify(t *testing.T, conn *dbus.Conn, prefix string) {
+	t.Helper()
+
+	if err := conn.Emit("/ca/desrt/dconf/Writer/user", "ca.desrt.dconf.Writer.Notify", prefix, []string{""}, "tag"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func spoofNotify(t *testing.T, conn *dbus.Conn, dest string, prefix string) {
+	t.Helper()
+
+	sendSignal(t, conn, dest, "/ca/desrt/dconf/Writer/user", "ca.desrt.dconf.Writer.Notify", prefix, []string{""}, "tag")
+}
+
+func TestWatchSender(t *testing.T) {
+	addr := testBusAddr(t)
+
+	conn := testConn(t, addr)
+	w := newWatchers(conn)
+	got := make(chan *dbus.Signal, 16)
+
+	// subscribed before dconf runs, its owner is picked up when it starts
+	defer w.watch(dconfNotify, func(sig *dbus.Signal) {
+		got <- sig
+	})()
+
+	dconf := testConn(t, addr)
+	ownName(t, dconf, "ca.desrt.dconf")
+
+	spoofer := testConn(t, addr)
+
+	// the owner's NameOwnerChanged may still be on its way
+	time.Sleep(100 * time.Millisecond)
+
+	notify(t, spoofer, "/spoofed/")
+	spoofNotify(t, spoofer, conn.Names()[0], "/spoofed/")
+	notify(t, dconf, "/real/")
+
+	if sig := nextSignal(got, 5*time.Second); sig == nil || sig.Body[0] != "/real/" {
+		t.Fatalf("got %v, want the Notify of dconf", sig)
+	}
+
+	if sig := nextSignal(got, 100*time.Millisecond); sig != nil {
+		t.Errorf("got %v from a peer not owning ca.desrt.dconf", sig.Body)
+	}
+
+	// a new dconf takes over, the old connection is nobody now
+	dconf.ReleaseName("ca.desrt.dconf")
+
+	next := testConn(t, addr)
+	ownName(t, next, "ca.desrt.dconf")
+
+	time.Sleep(100 * time.Millisecond)
+
+	spoofNotify(t, dconf, conn.Names()[0], "/old/")
+	notify(t, next, "/new/")
+
+	if sig := nextSignal(got, 5*time.Second); sig == nil || sig.Body[0] != "/new/" {
+		t.Fatalf("got %v, want the Notify of the new owner", sig)
+	}
+
+	if sig := nextSignal(got, 100*time.Millisecond); sig != nil {
+		t.Errorf("got %v from the previous owner", sig.Body)
+	}
+}
+
+func busMatchRules(t *testing.T, conn *dbus.Conn) uint32 {
+	t.Helper()
+
+	var stats map[string]dbus.Variant
+
+	if err := conn.BusObject().Call("org.freedesktop.DBus.Debug.Stats.GetStats", 0).Store(&stats); err != nil {
+		t.Skip("bus has no Debug.Stats:", err)
+	}
+
+	n, _ := stats["MatchRules"].Value().(uint32)
+
+	return n
+}
+
+func TestWatchRulesBounded(t *testing.T) {
+	addr := testBusAddr(t)
+
+	conn := testConn(t, addr)
+	w := newWatchers(conn)
+
+	other := matchRule{
+		sender: busName,
+		iface:  busName,
+		member: "NameLost",
+		path:   "/org/freedesktop/DBus",
+	}
+
+	before := busMatchRules(t, conn)
+
+	for i := 0; i < 50; i++ {
+		var unwatch []func()
+
+		for j := 0; j < 3; j++ {
+			unwatch = append(unwatch, w.watch(dconfNotify, func(*dbus.Signal) {}))
+			unwatch = append(unwatch, w.watch(other, func(*dbus.Signal) {}))
+		}
+
+		// one per distinct rule, plus following the owner of ca.desrt.dconf
+		if n := busMatchRules(t, conn); n != before+3 {
+			t.Fatalf("%d match rules while watching, want %d", n, before+3)
+		}
+
+		for _, cb := range unwatch {
+			cb()
+			// dropping twice is harmless
+			cb()
+		}
+	}
+
+	if n := busMatchRules(t, conn); n != before {
+		t.Errorf("%d match rules after teardown, %d before", n, before)
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if len(w.refs) != 0 || len(w.subs) != 0 || len(w.owners) != 0 || len(w.senders) != 0 {
+		t.Errorf("left refs %v subs %v owners %v senders %v", w.refs, w.subs, w.owners, w.senders)
+	}
+}
+
+func TestNameLostTakeover(t *testing.T) {
+	addr := testBusAddr(t)
+
+	isolate(t)
+
+	exited := make(chan int, 4)
+
+	exit = func(code int) {
+		exited <- code
+	}
+
+	defer func() {
+		exit = os.Exit
+	}()
+
+	p := newPortal(testConn(t, addr), nil)
+	defer p.serve(nameFlags(false))()
+
+	const service = "org.freedesktop.portal.Desktop"
+
+	spoofer := testConn(t, addr)
+	dest := p.conn.Names()[0]
+
+	sendSignal(t, spoofer, dest, "/org/freedesktop/DBus", "org.freedesktop.DBus.NameLost", service)
+	sendSignal(t, spoofer, dest, "/org/freedesktop/DBus", "org.freedesktop.DBus.NameLost")
+
+	select {
+	case code := <-exited:
+		t.Fatalf("exited %d on a NameLost from a peer", code)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	next := testConn(t, addr)
+	reply, err := next.RequestName(service, dbus.NameFlagDoNotQueue|dbus.NameFlagReplaceExisting)
+
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("replacement did not get %s: %v %v", service, reply, err)
+	}
+
+	select {
+	case code := <-exited:
+		if code != 0 {
+			t.Errorf("exited %d after the takeover, want 0", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not exit after losing the name")
+	}
+}